@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	rate "github.com/beefsack/go-rate"
+	"github.com/bluele/gcache"
+)
+
+// booru is an image board that the telegram bot core can fetch images from
+type booru interface {
+	// hello is the text sent back on /start and /help
+	hello() string
+	// commands are the backend-specific commands, in addition to hello/help/start
+	commands() map[string]func(context.Context, telegramUpdate) error
+	// search returns posts for the query, best first, and whether the booru had anything on the page
+	// before posts that can't be sent were filtered out, that is, whether the next page is worth asking for
+	search(ctx context.Context, query booruQuery) ([]booruPost, bool, error)
+	// getImage fetches a single post by its ID
+	getImage(ctx context.Context, id int64) (booruPost, error)
+	// postURL is the human-facing link to the post, used in captions
+	postURL(id int64) string
+	// postIDFromURL recognizes links to posts on the booru, like ones people paste from the browser
+	postIDFromURL(u *url.URL) (int64, bool)
+	// splitTags splits user input into tags the way the booru separates them
+	splitTags(s string) []string
+	// parseQuery parses user's search in the booru's own syntax
+	parseQuery(search string) (*queryNode, error)
+}
+
+// inlineBooru is implemented by backends that can answer inline queries
+type inlineBooru interface {
+	booru
+	// inlineMedia picks the representation that is used for inline query results
+	inlineMedia(post booruPost) (booruMedia, error)
+}
+
+// filterBooru is implemented by backends that hide images with server-side filters
+type filterBooru interface {
+	booru
+	// systemFilters are the public filters of the site that anyone can use
+	systemFilters(ctx context.Context) ([]booruFilter, error)
+}
+
+// reverseBooru is implemented by backends that can find posts by an image
+type reverseBooru interface {
+	booru
+	// reverseSearch finds posts that look like the image, closest first
+	reverseSearch(ctx context.Context, image []byte, filename string) ([]booruMatch, error)
+}
+
+// booruMatch is a post found by reverse search
+type booruMatch struct {
+	id       int64
+	post     booruPost // nil if the booru didn't return the post itself
+	distance float64   // how different the post is from the image on the booru's own scale, zero is the same image
+	within   bool      // distance is only the limit that the booru searched within, not the post's own
+}
+
+// booruFilter is a server-side filter of a booru
+type booruFilter struct {
+	ID          int
+	Name        string
+	Description string
+}
+
+// booruQuery is what we search for
+type booruQuery struct {
+	search    string // what the user typed
+	limiter   string // extra tag that the command always adds
+	rating    string // exact rating to search for, empty means anything up to maxRating
+	maxRating string // highest rating that the chat allows
+
+	blockedTags []string // tags blocked in the chat, on top of blocked_tags from the config
+	filterID    int      // filter chosen in the chat, zero means the site's default
+
+	page    int // which page of results to fetch, starting from 1, zero means first
+	perPage int // how many results per page, zero means backend's default
+}
+
+// pageKey is added to cache keys, so that every page is cached separately
+func (q booruQuery) pageKey() string {
+	if q.page <= 1 && q.perPage == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" page:%d per_page:%d", q.page, q.perPage)
+}
+
+// errPostNotFound is returned by getImage for posts that don't exist or are hidden
+var errPostNotFound = errors.New("Post not found")
+
+// sameHost reports whether u points to the site at baseURL, with or without www
+func sameHost(u *url.URL, baseURL url.URL) bool {
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	return host == strings.TrimPrefix(strings.ToLower(baseURL.Host), "www.")
+}
+
+// parsePostID parses the number in post links, only positive numbers are post IDs
+func parsePostID(s string) (int64, bool) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 || strings.HasPrefix(s, "+") {
+		return 0, false
+	}
+	return id, true
+}
+
+// parseBaseURL checks that s is a http(s) URL without query, like https://derpibooru.org
+func parseBaseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(s, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("URL %q must start with https:// or http://", s)
+	}
+	if u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("URL %q must be just the site, like https://example.com", s)
+	}
+	return u, nil
+}
+
+// booruPost is a single post returned by a booru backend
+type booruPost interface {
+	postID() int64
+	postScore() int64
+	// postRating is one of ratings, empty if the post has none
+	postRating() string
+	// postTags are all tags of the post, lowercase
+	postTags() []string
+	// postArtists are names of the artists of the post
+	postArtists() []string
+	// postSources are links to where the post was taken from
+	postSources() []string
+	// media picks the representation of the post that telegram will accept
+	media() (booruMedia, error)
+}
+
+// booruMedia is what we send to telegram for a single post
+type booruMedia struct {
+	kind     string // one of "photo", "animation" or "document"
+	url      *url.URL
+	thumbURL *url.URL
+	width    int
+	height   int
+	filename string
+	spoiler  bool // hide behind a spoiler until tapped
+}
+
+var (
+	cache = gcache.New(100).LRU().Expiration(cacheDuration * time.Second).Build()
+)
+
+// parseMediaURL parses location and fills in https scheme for protocol-relative URLs
+func parseMediaURL(location string) (*url.URL, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	return u, nil
+}
+
+// cache maps URL to []byte
+func cachedGet(ctx context.Context, location string, cacheKey string, rl *rate.RateLimiter) ([]byte, error) {
+	// check cache
+	{
+		cached, err := cache.Get(cacheKey)
+		switch err {
+		case nil:
+			// found, return the data
+			cached, ok := cached.([]byte)
+			if ok {
+				// trace("Found key %s in cache: %d bytes", cacheKey, len(cached))
+				return cached, nil
+			}
+			log.Printf("SHOULD NOT HAPPEN -- fetched data from cache for key \"%s\" is not []byte!", cacheKey)
+		case gcache.KeyNotFoundError:
+			// do nothing, not found
+		default:
+			// log but continue working, cache might be down
+			log.Printf("Couldn't fetch data from cache for key \"%s\": %s", cacheKey, err)
+		}
+	}
+
+	// ratelimit if neccessary
+	err := waitRate(ctx, rl)
+	if err != nil {
+		return nil, err
+	}
+	// fetch from network
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare a request for url %q: %s", location, err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't fetch url \"%s\": %s", location, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read body of url \"%s\": %s", location, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Got 404 from url \"%s\": %w", location, errPostNotFound)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected status code %d from url \"%s\"", resp.StatusCode, location)
+	}
+
+	if !isJSON(body) {
+		return nil, fmt.Errorf("Body of url \"%s\" is not a JSON", location)
+	}
+
+	// save cache
+	// trace("Saving %s into cache: %d bytes", cacheKey, len(body))
+	err = cache.Set(cacheKey, body)
+	if err != nil {
+		log.Printf("Couldn't set cache data for key \"%s\": %s", cacheKey, err)
+		// don't fail, it's a temporary error and next time it might be fine
+	}
+
+	return body, nil
+}
+
+// waitRate blocks until the rate limit allows another request, or ctx is done
+func waitRate(ctx context.Context, rl *rate.RateLimiter) error {
+	for {
+		ok, remaining := rl.Try()
+		if ok {
+			return nil
+		}
+		err := sleepContext(ctx, remaining)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// postMultipart uploads the params, e.g. an image for reverse search, responses are never cached
+func postMultipart(ctx context.Context, location string, params mimeValues, rl *rate.RateLimiter) ([]byte, error) {
+	body, contentType, err := params.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	err = waitRate(ctx, rl)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", location, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare a request for url %q: %s", location, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't post to url \"%s\": %s", location, err)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read body of url \"%s\": %s", location, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected status code %d from url \"%s\"", resp.StatusCode, location)
+	}
+	if !isJSON(respBody) {
+		return nil, fmt.Errorf("Body of url \"%s\" is not a JSON", location)
+	}
+	return respBody, nil
+}
+
+func isJSON(s []byte) bool {
+	var js interface{}
+	return json.Unmarshal(s, &js) == nil
+}
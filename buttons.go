@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const maxCallbackData = 64 // telegram refuses buttons with longer callback_data
+
+// imageButtons are the buttons under an image the bot sends in reply to the message, nil if the chat doesn't want them.
+// Another is only there for images found by a search, it continues the search remembered with rememberButtonSearch
+// for the message. Clients can send any callback data, so who may delete the image is never taken from it.
+func imageButtons(message *telegramMessage, site string, id int64, another bool) *telegramInlineKeyboardMarkup {
+	if !chatButtons(message.Chat.ID) {
+		return nil
+	}
+	row := []telegramInlineKeyboardButton{}
+	if another {
+		row = append(row, telegramInlineKeyboardButton{Text: "Another", CallbackData: fmt.Sprintf("another:%d", message.ID)})
+	}
+	// long site names don't fit, those images go without Tags and Source
+	for _, button := range []telegramInlineKeyboardButton{
+		{Text: "Tags", CallbackData: fmt.Sprintf("tags:%s:%d", site, id)},
+		{Text: "Source", CallbackData: fmt.Sprintf("source:%s:%d", site, id)},
+	} {
+		if site != "" && len(button.CallbackData) <= maxCallbackData {
+			row = append(row, button)
+		}
+	}
+	row = append(row, telegramInlineKeyboardButton{Text: "Delete", CallbackData: "delete"})
+	return &telegramInlineKeyboardMarkup{InlineKeyboard: [][]telegramInlineKeyboardButton{row}}
+}
+
+// --------------------
+// button handlers
+// --------------------
+
+// handleCallback handles presses of the buttons from imageButtons
+func handleCallback(ctx context.Context, update telegramUpdate) error {
+	query := update.CallbackQuery
+	if query.Message == nil || query.From == nil {
+		return bot.answerCallbackQuery(ctx, query.ID, "Sorry, this message is too old.", false)
+	}
+	parts := strings.SplitN(query.Data, ":", 2)
+	action, arg := parts[0], ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+	switch action {
+	case "another":
+		return handleAnotherButton(ctx, query, arg)
+	case "tags", "source":
+		return handlePostButton(ctx, query, action, arg)
+	case "delete":
+		return handleDeleteButton(ctx, query)
+	}
+	return bot.answerCallbackQuery(ctx, query.ID, "", false)
+}
+
+// handleAnotherButton continues the search that found the image, in reply to the image
+func handleAnotherButton(ctx context.Context, query *telegramCallbackQuery, arg string) error {
+	searchMessageID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return bot.answerCallbackQuery(ctx, query.ID, "", false)
+	}
+	chatID := query.Message.Chat.ID
+	search, ok := buttonSearch(chatID, searchMessageID)
+	if !ok {
+		return bot.answerCallbackQuery(ctx, query.ID, "Sorry, this search is too old, search for something again.", false)
+	}
+	err = bot.answerCallbackQuery(ctx, query.ID, "", false)
+	if err != nil {
+		return err
+	}
+
+	message := *query.Message
+	message.Text = ""
+	message.From = query.From
+	if search.By != 0 {
+		// the next image is still for whoever searched
+		message.From = &telegramUser{ID: search.By}
+	}
+	next, err := sendNext(ctx, telegramUpdate{Message: &message}, search, 1)
+	if err != nil {
+		return err
+	}
+	// pressing it again sends the image after that one
+	rememberButtonSearch(chatID, searchMessageID, next)
+	return nil
+}
+
+// handlePostButton shows tags or artists and sources of the post in the caption, instead of what was there
+func handlePostButton(ctx context.Context, query *telegramCallbackQuery, action string, arg string) error {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 {
+		return bot.answerCallbackQuery(ctx, query.ID, "", false)
+	}
+	backend, ok := bot.sites[parts[0]]
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if !ok || err != nil {
+		return bot.answerCallbackQuery(ctx, query.ID, "Sorry, I don't know that site anymore.", false)
+	}
+	post, err := backend.getImage(ctx, id)
+	if errors.Is(err, errPostNotFound) {
+		return bot.answerCallbackQuery(ctx, query.ID, "Sorry, this post is gone.", false)
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := []string{backend.postURL(id)}
+	switch action {
+	case "tags":
+		lines = append(lines, "Tags: "+strings.Join(post.postTags(), ", "))
+	case "source":
+		if artists := post.postArtists(); len(artists) > 0 {
+			lines = append(lines, "Artist: "+strings.Join(artists, ", "))
+		}
+		sources := post.postSources()
+		if len(sources) == 0 {
+			lines = append(lines, "No source on "+parts[0])
+		} else {
+			lines = append(lines, "Source: "+strings.Join(sources, "\n"))
+		}
+	}
+	caption := truncateCaption(strings.Join(lines, "\n"))
+	if caption != query.Message.Caption {
+		// telegram refuses edits that change nothing
+		err = bot.editMessageCaption(ctx, query.Message.Chat.ID, query.Message.ID, caption, query.Message.ReplyMarkup)
+		if err != nil {
+			return err
+		}
+	}
+	return bot.answerCallbackQuery(ctx, query.ID, "", false)
+}
+
+// imageRequester is who asked for the image in the message, zero if it's not known.
+// It comes from the message the image replied to, which telegram fills in, never from callback data.
+func imageRequester(message *telegramMessage) int64 {
+	asked := message.ReplyToMessage
+	if asked == nil {
+		return 0
+	}
+	// images sent by Another reply to the image before them, the search behind that one knows who searched
+	if search, ok := buttonSearch(message.Chat.ID, asked.ID); ok && search.By != 0 {
+		return search.By
+	}
+	if asked.From != nil && !asked.From.Bot {
+		return asked.From.ID
+	}
+	return 0
+}
+
+// handleDeleteButton deletes the image if the one who asked for it or a chat admin pressed the button
+func handleDeleteButton(ctx context.Context, query *telegramCallbackQuery) error {
+	requester := imageRequester(query.Message)
+	allowed := requester != 0 && query.From.ID == requester
+	if !allowed {
+		var err error
+		allowed, err = bot.isChatAdmin(ctx, &telegramMessage{Chat: query.Message.Chat, From: query.From})
+		if err != nil {
+			return err
+		}
+	}
+	if !allowed {
+		return bot.answerCallbackQuery(ctx, query.ID, "Sorry, only the one who asked for this image or chat admins can delete it.", true)
+	}
+	err := bot.deleteMessage(ctx, query.Message.Chat.ID, query.Message.ID)
+	if err != nil {
+		return err
+	}
+	return bot.answerCallbackQuery(ctx, query.ID, "", false)
+}
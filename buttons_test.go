@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// useButtons turns buttons under images on in the chat until the test ends
+func useButtons(t *testing.T, chatID int64) {
+	err := bot.chats.update(chatID, func(settings *chatSettings) {
+		settings.Buttons = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bot.chats.update(chatID, func(settings *chatSettings) {
+			settings.Buttons = false
+		})
+	})
+}
+
+func TestImageButtons(t *testing.T) {
+	tests := []struct {
+		name     string
+		buttons  bool
+		text     string
+		expected string // callback data of the buttons, empty if there are none
+	}{
+		{name: "buttons off", text: "/pony fluttershy"},
+		{name: "search", buttons: true, text: "/pony fluttershy", expected: "another:10 tags:derpibooru:1001 source:derpibooru:1001 delete"},
+		{name: "post has nothing to continue", buttons: true, text: "/pony 1001", expected: "tags:derpibooru:1001 source:derpibooru:1001 delete"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			d, _ := newTestDerpibooru(t)
+			useSites(t, d)
+			chatID := int64(1000)
+			forgetHistory(t, chatID)
+			if test.buttons {
+				useButtons(t, chatID)
+			}
+
+			handleUpdate(context.Background(), testMessage(chatID, test.text))
+
+			calls := telegram.called("sendPhoto")
+			if len(calls) != 1 {
+				t.Fatalf("expected a photo, got %v", telegram.calls)
+			}
+			markup := calls[0].params.Get("reply_markup")
+			if test.expected == "" {
+				if markup != "" {
+					t.Errorf("expected no buttons, got %s", markup)
+				}
+				return
+			}
+			keyboard := telegramInlineKeyboardMarkup{}
+			err := json.Unmarshal([]byte(markup), &keyboard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := []string{}
+			for _, button := range keyboard.InlineKeyboard[0] {
+				data = append(data, button.CallbackData)
+			}
+			if got := strings.Join(data, " "); got != test.expected {
+				t.Errorf("buttons are %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestHandleCallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		from     int64  // who pressed the button
+		member   string // their status in the chat
+		afterBot bool   // the image replied to an earlier image, like ones sent by Another do
+		method   string
+		param    string
+		expected string // {booru} is replaced with the fake booru URL
+	}{
+		{
+			name: "tags", data: "tags:derpibooru:1001", from: 1,
+			method: "editMessageCaption", param: "caption", expected: "{booru}/1001\nTags: artist:mixermilk, fluttershy, safe, solo",
+		},
+		{
+			name: "source", data: "source:derpibooru:1001", from: 1,
+			method: "editMessageCaption", param: "caption", expected: "{booru}/1001\nArtist: mixermilk\nSource: https://example.com/fluttershy",
+		},
+		{
+			name: "another", data: "another:10", from: 2,
+			method: "sendAnimation", param: "caption", expected: "{booru}/1002\nNext image for your search",
+		},
+		{
+			name: "another for a forgotten search", data: "another:9", from: 1,
+			method: "answerCallbackQuery", param: "text", expected: "Sorry, this search is too old, search for something again.",
+		},
+		{
+			name: "delete by who asked", data: "delete", from: 1,
+			method: "deleteMessage", param: "message_id", expected: "20",
+		},
+		{
+			name: "delete of an image after another one by who asked", data: "delete", from: 1, afterBot: true,
+			method: "deleteMessage", param: "message_id", expected: "20",
+		},
+		{
+			name: "delete by an admin", data: "delete", from: 2, member: "administrator",
+			method: "deleteMessage", param: "message_id", expected: "20",
+		},
+		{
+			name: "delete by someone else", data: "delete", from: 2, member: "member",
+			method: "answerCallbackQuery", param: "text", expected: "Sorry, only the one who asked for this image or chat admins can delete it.",
+		},
+		{
+			name: "delete by someone else who names themselves in the data", data: "delete:2", from: 2, member: "member",
+			method: "answerCallbackQuery", param: "text", expected: "Sorry, only the one who asked for this image or chat admins can delete it.",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			if test.member != "" {
+				telegram.results["getChatMember"] = `{"status": "` + test.member + `"}`
+			}
+			d, booru := newTestDerpibooru(t)
+			useSites(t, d)
+			chatID := int64(-1001000 - i)
+			forgetHistory(t, chatID)
+			forgetSearches(t, chatID)
+			useButtons(t, chatID)
+
+			// user 1 asks for an image in a group
+			search := testMessage(chatID, "/pony fluttershy")
+			search.Message.Chat.Type = "supergroup"
+			search.Message.From = &telegramUser{ID: 1, FirstName: "Tester"}
+			handleUpdate(context.Background(), search)
+
+			repliedTo := search.Message
+			if test.afterBot {
+				repliedTo = &telegramMessage{ID: 10, From: &telegramUser{ID: 99, Bot: true}, Chat: search.Message.Chat}
+			}
+			handleUpdate(context.Background(), telegramUpdate{
+				ID: 2,
+				CallbackQuery: &telegramCallbackQuery{
+					ID:   "query",
+					From: &telegramUser{ID: test.from, FirstName: "Presser"},
+					Message: &telegramMessage{
+						ID:             20,
+						Chat:           search.Message.Chat,
+						Caption:        booru.baseURL.String() + "/1001\nBest recent image for your search",
+						ReplyToMessage: repliedTo,
+					},
+					Data: test.data,
+				},
+			})
+
+			calls := telegram.called(test.method)
+			if len(calls) == 0 {
+				t.Fatalf("expected %s, got %v", test.method, telegram.calls)
+			}
+			expected := strings.ReplaceAll(test.expected, "{booru}", booru.baseURL.String())
+			if got := calls[len(calls)-1].params.Get(test.param); got != expected {
+				t.Errorf("%s is %q, expected %q", test.param, got, expected)
+			}
+			if answers := telegram.called("answerCallbackQuery"); len(answers) != 1 || answers[0].params.Get("callback_query_id") != "query" {
+				t.Errorf("expected the button press to be answered once, got %v", answers)
+			}
+		})
+	}
+}
+
+func TestAnotherContinuesItsOwnSearch(t *testing.T) {
+	newFakeTelegram(t)
+	d, _ := newTestDerpibooru(t)
+	useSites(t, d)
+	chatID := int64(1100)
+	forgetHistory(t, chatID)
+	forgetSearches(t, chatID)
+	useButtons(t, chatID)
+
+	first := testMessage(chatID, "/pony fluttershy")
+	handleUpdate(context.Background(), first)
+	// a newer search must not change what Another under the first image continues
+	newer := testMessage(chatID, "/pony applejack")
+	newer.Message.ID = 11
+	handleUpdate(context.Background(), newer)
+
+	handleUpdate(context.Background(), telegramUpdate{
+		ID: 2,
+		CallbackQuery: &telegramCallbackQuery{
+			ID:      "query",
+			From:    &telegramUser{ID: chatID, FirstName: "Tester"},
+			Message: &telegramMessage{ID: 20, Chat: first.Message.Chat},
+			Data:    "another:10",
+		},
+	})
+
+	// the image sent by Another has its own Another button for the same search
+	if next, ok := buttonSearch(chatID, 20); !ok || next.Search != "fluttershy" {
+		t.Errorf("Another continued %+v, expected fluttershy", next)
+	}
+	if last, _ := lastSearchFor(first.Message); last.Search != "applejack" {
+		t.Errorf("Another changed the last search to %+v, expected applejack", last)
+	}
+}
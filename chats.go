@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ratings from the most innocent to the least, chats can allow up to one of them
+var ratings = []string{"safe", "suggestive", "questionable", "explicit"}
+
+// chatSettings is what chat admins can change with /settings
+type chatSettings struct {
+	MaxRating   string   `json:"max_rating,omitempty"`
+	BlockedTags []string `json:"blocked_tags,omitempty"`
+	Site        string   `json:"site,omitempty"` // booru that the chat uses, the backend if empty
+	// filters chosen with /filter by site name, filter IDs only make sense on their own site
+	FilterIDs map[string]int `json:"filter_ids,omitempty"`
+	Previews  bool           `json:"previews,omitempty"` // preview links to posts that people paste
+	Buttons   bool           `json:"buttons,omitempty"`  // buttons under images the bot sends
+	Album     int            `json:"album,omitempty"`    // most images one command sends, album_limit if zero
+}
+
+const (
+	maxChatBlockedTags = 100 // so that queries to booru don't grow without limit
+)
+
+// chatStore keeps settings of every chat in the storage
+type chatStore struct {
+	store storage
+}
+
+func newChatStore(store storage) *chatStore {
+	return &chatStore{store: store}
+}
+
+func (s *chatStore) get(chatID int64) chatSettings {
+	var settings chatSettings
+	s.store.view(func(data *storedData) {
+		settings = data.Chats[chatID]
+	})
+	return settings
+}
+
+// update changes settings of the chat and saves them
+func (s *chatStore) update(chatID int64, change func(settings *chatSettings)) error {
+	return s.store.update(func(data *storedData) {
+		settings := data.Chats[chatID]
+		// slices and maps are shared with whoever called get, so change a copy
+		settings.BlockedTags = append([]string(nil), settings.BlockedTags...)
+		filterIDs := map[string]int{}
+		for site, filterID := range settings.FilterIDs {
+			filterIDs[site] = filterID
+		}
+		settings.FilterIDs = filterIDs
+		change(&settings)
+		data.Chats[chatID] = settings
+	})
+}
+
+// ratingLevel returns position of rating in ratings, or -1 if it's not a rating
+func ratingLevel(rating string) int {
+	for i, r := range ratings {
+		if r == rating {
+			return i
+		}
+	}
+	return -1
+}
+
+// ratingAllowed reports whether rating doesn't go above maxRating
+func ratingAllowed(rating, maxRating string) bool {
+	return ratingLevel(rating) <= ratingLevel(maxRating)
+}
+
+// chatMaxRating is the highest rating allowed in the chat
+func chatMaxRating(chatID int64) string {
+	if bot.chats != nil {
+		if maxRating := bot.chats.get(chatID).MaxRating; maxRating != "" {
+			return maxRating
+		}
+	}
+	if bot.DefaultMaxRating != "" {
+		return bot.DefaultMaxRating
+	}
+	return "explicit"
+}
+
+// chatBlockedTags are the tags blocked in the chat with /block
+func chatBlockedTags(chatID int64) []string {
+	if bot.chats == nil {
+		return nil
+	}
+	return bot.chats.get(chatID).BlockedTags
+}
+
+// chatFilterID is the filter picked in the chat with /filter for the site, zero means the site's default
+func chatFilterID(chatID int64, site string) int {
+	if bot.chats == nil {
+		return 0
+	}
+	return bot.chats.get(chatID).FilterIDs[site]
+}
+
+// chatButtons reports whether the chat wants buttons under images
+func chatButtons(chatID int64) bool {
+	if bot.chats == nil {
+		return false
+	}
+	return bot.chats.get(chatID).Buttons
+}
+
+// migrateChat moves settings, history and searches of a group to the supergroup it was upgraded to,
+// and remembers the new chat ID for replies to messages from the old group
+func migrateChat(oldChatID, newChatID int64) error {
+	if bot.store == nil || oldChatID == newChatID {
+		return nil
+	}
+	return bot.store.update(func(data *storedData) {
+		if data.ChatMigrations[oldChatID] == newChatID {
+			// telegram tells both chats, so it was moved already
+			return
+		}
+		log.Printf("Chat %d was upgraded to %d, moving its settings there", oldChatID, newChatID)
+		data.ChatMigrations[oldChatID] = newChatID
+		if settings, ok := data.Chats[oldChatID]; ok {
+			if _, taken := data.Chats[newChatID]; !taken {
+				data.Chats[newChatID] = settings
+			}
+			delete(data.Chats, oldChatID)
+		}
+		if history := data.History[oldChatID]; len(history) > 0 {
+			data.History[newChatID] = append(history, data.History[newChatID]...)
+			delete(data.History, oldChatID)
+		}
+		if searches, ok := data.Searches[oldChatID]; ok {
+			if _, taken := data.Searches[newChatID]; !taken {
+				data.Searches[newChatID] = searches
+			}
+			delete(data.Searches, oldChatID)
+		}
+	})
+}
+
+// chatAlbumLimit is the most images one command sends to the chat
+func chatAlbumLimit(chatID int64) int {
+	if bot.chats != nil {
+		if limit := bot.chats.get(chatID).Album; limit > 0 {
+			return limit
+		}
+	}
+	switch {
+	case bot.AlbumLimit > maxMediaGroup:
+		return maxMediaGroup
+	case bot.AlbumLimit > 0:
+		return bot.AlbumLimit
+	}
+	return defaultAlbumLimit
+}
+
+// chatPreviews reports whether the chat turned on previews of pasted links
+func chatPreviews(chatID int64) bool {
+	if bot.chats == nil {
+		return false
+	}
+	return bot.chats.get(chatID).Previews
+}
+
+// chatSite is the booru that the chat picked with /site
+func chatSite(chatID int64) booru {
+	if bot.chats != nil {
+		if site, ok := bot.sites[bot.chats.get(chatID).Site]; ok {
+			return site
+		}
+	}
+	return bot.backend
+}
+
+// siteName finds the name of the booru in sites
+func siteName(backend booru) string {
+	for name, site := range bot.sites {
+		if site == backend {
+			return name
+		}
+	}
+	return ""
+}
+
+// siteNames are names of all sites, sorted
+func siteNames() []string {
+	names := []string{}
+	for name := range bot.sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isValidSiteName checks that the name can be used after @ in commands
+func isValidSiteName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// refuseRating politely tells that the rating is above what the chat allows
+func refuseRating(ctx context.Context, update telegramUpdate, rating, maxRating string) error {
+	message := fmt.Sprintf("Sorry, %s images are not allowed in this chat, it only allows up to %s.", rating, maxRating)
+	if update.Message.Chat.Type != "private" {
+		message += " Chat admins can change that with /settings rating <level>."
+	}
+	return bot.sendMessage(ctx, update, message)
+}
+
+// isChatAdmin checks whether the author of the message can change settings of the chat
+func (b *telegramBot) isChatAdmin(ctx context.Context, message *telegramMessage) (bool, error) {
+	if message.Chat.Type == "private" {
+		return true, nil
+	}
+	// anonymous admins write on behalf of the group itself
+	if message.SenderChat != nil && message.SenderChat.ID == message.Chat.ID {
+		return true, nil
+	}
+	if message.From == nil {
+		return false, nil
+	}
+
+	params := mimeValues{}
+	err := params.Add("chat_id", message.Chat.ID)
+	if err != nil {
+		return false, err
+	}
+	err = params.Add("user_id", message.From.ID)
+	if err != nil {
+		return false, err
+	}
+	member := telegramChatMember{}
+	err = b.sendInternalResult(ctx, "getChatMember", params, telegramUpdate{}, &member)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get chat member: %w", err)
+	}
+	return member.Status == "creator" || member.Status == "administrator", nil
+}
+
+// --------------------
+// chat settings command handlers
+// --------------------
+func handleSettings(ctx context.Context, update telegramUpdate) error {
+	args := strings.Fields(strings.ToLower(update.Message.CommandOptions()))
+	chatID := update.Message.Chat.ID
+	usage := fmt.Sprintf("/settings rating <%s>\n/settings previews <on|off>\n/settings buttons <on|off>\n/settings album <1-%d>", strings.Join(ratings, "|"), maxMediaGroup)
+	if len(args) == 0 {
+		message := fmt.Sprintf("Settings of this chat:\n\nrating: up to %s\npreviews: %s\nbuttons: %s\nalbum: up to %d images\n\nTo change them:\n%s",
+			chatMaxRating(chatID), onOff(chatPreviews(chatID)), onOff(chatButtons(chatID)), chatAlbumLimit(chatID), usage)
+		return bot.sendMessage(ctx, update, message)
+	}
+
+	var change func(settings *chatSettings)
+	var done string
+	switch {
+	case len(args) != 2:
+	case args[0] == "rating" && ratingLevel(args[1]) != -1:
+		rating := args[1]
+		change = func(settings *chatSettings) { settings.MaxRating = rating }
+		done = fmt.Sprintf("Done, this chat now allows images up to %s.", rating)
+	case args[0] == "previews" && (args[1] == "on" || args[1] == "off"):
+		previews := args[1] == "on"
+		change = func(settings *chatSettings) { settings.Previews = previews }
+		done = fmt.Sprintf("Done, previews of links are now %s in this chat.", args[1])
+	case args[0] == "buttons" && (args[1] == "on" || args[1] == "off"):
+		buttons := args[1] == "on"
+		change = func(settings *chatSettings) { settings.Buttons = buttons }
+		done = fmt.Sprintf("Done, buttons under images are now %s in this chat.", args[1])
+	case args[0] == "album":
+		limit, err := strconv.Atoi(args[1])
+		if err != nil || limit < 1 || limit > maxMediaGroup {
+			break
+		}
+		change = func(settings *chatSettings) { settings.Album = limit }
+		done = fmt.Sprintf("Done, commands now send up to %d images at once in this chat.", limit)
+	}
+	if change == nil {
+		return bot.sendMessage(ctx, update, "Usage:\n"+usage)
+	}
+
+	isAdmin, err := requireAdmin(ctx, update)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	err = bot.chats.update(chatID, change)
+	if err != nil {
+		return fmt.Errorf("Failed to save chat settings: %w", err)
+	}
+	return bot.sendMessage(ctx, update, done)
+}
+
+func handleSite(ctx context.Context, update telegramUpdate) error {
+	args := strings.Fields(strings.ToLower(update.Message.CommandOptions()))
+	chatID := update.Message.Chat.ID
+	names := siteNames()
+	if len(args) == 0 {
+		message := fmt.Sprintf("This chat uses %s.\n\nSites: %s\n\nTo change it: /site <name>\nTo use another site once: /pony site:<name> <search>", siteName(chatSite(chatID)), strings.Join(names, ", "))
+		return bot.sendMessage(ctx, update, message)
+	}
+	if len(args) != 1 || !containsString(names, args[0]) {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Usage: /site <%s>", strings.Join(names, "|")))
+	}
+
+	isAdmin, err := requireAdmin(ctx, update)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	site := args[0]
+	err = bot.chats.update(chatID, func(settings *chatSettings) {
+		settings.Site = site
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save chat settings: %w", err)
+	}
+	return bot.sendMessage(ctx, update, fmt.Sprintf("Done, this chat now uses %s.", site))
+}
+
+func handleFilter(ctx context.Context, update telegramUpdate) error {
+	backend, _ := siteFor(update.Message)
+	site := siteName(backend)
+	filtering, ok := backend.(filterBooru)
+	if !ok {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, %s has no filters.", site))
+	}
+	filters, err := filtering.systemFilters(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to get filters: %w", err)
+	}
+
+	chatID := update.Message.Chat.ID
+	arg := strings.TrimSpace(update.Message.CommandOptions())
+	if arg == "" {
+		current := chatFilterID(chatID, site)
+		lines := []string{}
+		for _, filter := range filters {
+			line := fmt.Sprintf("%d: %s", filter.ID, filter.Name)
+			if filter.ID == current {
+				line += " (used in this chat)"
+			}
+			lines = append(lines, line)
+		}
+		message := fmt.Sprintf("Filters on %s:\n\n%s\n\n", site, strings.Join(lines, "\n"))
+		if current == 0 {
+			message += "This chat uses the default filter. "
+		}
+		message += "To change it: /filter <name or number>\nTo go back to the default: /filter default"
+		return bot.sendMessage(ctx, update, message)
+	}
+
+	filterID, name := 0, "the default filter"
+	if !strings.EqualFold(arg, "default") {
+		filterID, name = findFilter(filters, arg)
+		if filterID == 0 {
+			return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, there's no filter %q on %s, /filter lists them.", arg, site))
+		}
+	}
+
+	isAdmin, err := requireAdmin(ctx, update)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	err = bot.chats.update(chatID, func(settings *chatSettings) {
+		if filterID == 0 {
+			delete(settings.FilterIDs, site)
+			return
+		}
+		settings.FilterIDs[site] = filterID
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save chat settings: %w", err)
+	}
+	return bot.sendMessage(ctx, update, fmt.Sprintf("Done, this chat now uses %s on %s.", name, site))
+}
+
+// findFilter finds filter by its name or number, any number is accepted since users can make their filters public
+func findFilter(filters []booruFilter, arg string) (int, string) {
+	for _, filter := range filters {
+		if strings.EqualFold(filter.Name, arg) || strconv.Itoa(filter.ID) == arg {
+			return filter.ID, filter.Name
+		}
+	}
+	if id, err := strconv.Atoi(arg); err == nil && id > 0 {
+		return id, fmt.Sprintf("filter %d", id)
+	}
+	return 0, ""
+}
+
+func handleBlock(ctx context.Context, update telegramUpdate) error {
+	tags := bot.backend.splitTags(update.Message.CommandOptions())
+	if len(tags) == 0 {
+		return bot.sendMessage(ctx, update, "Usage: /block <tag>")
+	}
+	isAdmin, err := requireAdmin(ctx, update)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	// either all tags are blocked or none, so that the reply tells what happened
+	tooMany := false
+	blocked := 0
+	err = bot.chats.update(update.Message.Chat.ID, func(settings *chatSettings) {
+		added := []string{}
+		for _, tag := range tags {
+			if !containsString(settings.BlockedTags, tag) && !containsString(added, tag) {
+				added = append(added, tag)
+			}
+		}
+		blocked = len(settings.BlockedTags)
+		if blocked+len(added) > maxChatBlockedTags {
+			tooMany = true
+			return
+		}
+		settings.BlockedTags = append(settings.BlockedTags, added...)
+		sort.Strings(settings.BlockedTags)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save chat settings: %w", err)
+	}
+	if tooMany {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, a chat can't block more than %d tags and %d are blocked already, so none of these were blocked.", maxChatBlockedTags, blocked))
+	}
+	return bot.sendMessage(ctx, update, "Blocked: "+strings.Join(tags, ", "))
+}
+
+func handleUnblock(ctx context.Context, update telegramUpdate) error {
+	tags := bot.backend.splitTags(update.Message.CommandOptions())
+	if len(tags) == 0 {
+		return bot.sendMessage(ctx, update, "Usage: /unblock <tag>")
+	}
+	isAdmin, err := requireAdmin(ctx, update)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	err = bot.chats.update(update.Message.Chat.ID, func(settings *chatSettings) {
+		kept := []string{}
+		for _, tag := range settings.BlockedTags {
+			if !containsString(tags, tag) {
+				kept = append(kept, tag)
+			}
+		}
+		settings.BlockedTags = kept
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save chat settings: %w", err)
+	}
+	return bot.sendMessage(ctx, update, "Unblocked: "+strings.Join(tags, ", "))
+}
+
+func handleBlocklist(ctx context.Context, update telegramUpdate) error {
+	tags := chatBlockedTags(update.Message.Chat.ID)
+	if len(tags) == 0 {
+		return bot.sendMessage(ctx, update, "No tags are blocked in this chat. To block one: /block <tag>")
+	}
+	return bot.sendMessage(ctx, update, "Tags blocked in this chat:\n\n"+strings.Join(tags, "\n"))
+}
+
+// requireAdmin tells the user off if they're not an admin of the chat
+func requireAdmin(ctx context.Context, update telegramUpdate) (bool, error) {
+	isAdmin, err := bot.isChatAdmin(ctx, update.Message)
+	if err != nil {
+		return false, err
+	}
+	if !isAdmin {
+		return false, bot.sendMessage(ctx, update, "Sorry, only chat admins can change settings.")
+	}
+	return true, nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRatingAllowed(t *testing.T) {
+	tests := []struct {
+		rating    string
+		maxRating string
+		allowed   bool
+	}{
+		{"safe", "safe", true},
+		{"suggestive", "safe", false},
+		{"explicit", "questionable", false},
+		{"questionable", "explicit", true},
+		{"safe", "explicit", true},
+	}
+	for _, test := range tests {
+		if got := ratingAllowed(test.rating, test.maxRating); got != test.allowed {
+			t.Errorf("ratingAllowed(%q, %q) = %v, expected %v", test.rating, test.maxRating, got, test.allowed)
+		}
+	}
+}
+
+func TestChatStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bot.data.json")
+
+	data, err := openFileStorage(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newChatStore(data)
+	err = store.update(-100123, func(settings *chatSettings) {
+		settings.MaxRating = "safe"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = openFileStorage(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = newChatStore(data)
+	if got := store.get(-100123).MaxRating; got != "safe" {
+		t.Fatalf("expected max rating safe after reload, got %q", got)
+	}
+	if got := store.get(42).MaxRating; got != "" {
+		t.Fatalf("expected no max rating for unknown chat, got %q", got)
+	}
+}
+
+func TestMigrateChat(t *testing.T) {
+	tests := []struct {
+		name    string
+		message telegramMessage // service message about the upgrade
+	}{
+		{"in the old group", telegramMessage{Chat: telegramChat{ID: -300, Type: "group"}, MigrateToChatID: -100300}},
+		{"in the supergroup", telegramMessage{Chat: telegramChat{ID: -100300, Type: "supergroup"}, MigrateFromChatID: -300}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldChatID, newChatID := int64(-300), int64(-100300)
+			err := bot.store.update(func(data *storedData) {
+				data.Chats[oldChatID] = chatSettings{MaxRating: "safe", BlockedTags: []string{"spider"}}
+				data.History[oldChatID] = []sentImage{{Site: "derpibooru", ID: 1001, SentAt: time.Now()}}
+				data.Searches[oldChatID] = chatSearches{Chat: lastSearch{Site: "derpibooru", Search: "fluttershy", At: time.Now()}}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				bot.store.update(func(data *storedData) {
+					for _, chatID := range []int64{oldChatID, newChatID} {
+						delete(data.Chats, chatID)
+						delete(data.History, chatID)
+						delete(data.Searches, chatID)
+					}
+					delete(data.ChatMigrations, oldChatID)
+				})
+			})
+
+			message := test.message
+			handleUpdate(context.Background(), telegramUpdate{ID: 1, Message: &message})
+
+			if got := chatMaxRating(newChatID); got != "safe" {
+				t.Errorf("supergroup allows up to %q, expected safe", got)
+			}
+			if got := chatBlockedTags(newChatID); len(got) != 1 || got[0] != "spider" {
+				t.Errorf("supergroup blocks %v, expected spider", got)
+			}
+			if got := recentlySent(newChatID); !got[sentImage{Site: "derpibooru", ID: 1001}] {
+				t.Errorf("supergroup history is %v, expected 1001", got)
+			}
+			if last, ok := lastSearchFor(&telegramMessage{Chat: telegramChat{ID: newChatID}}); !ok || last.Search != "fluttershy" {
+				t.Errorf("supergroup continues %+v, expected fluttershy", last)
+			}
+			if got := bot.migratedChatID(oldChatID); got != newChatID {
+				t.Errorf("replies to the old group go to %d, expected %d", got, newChatID)
+			}
+			bot.store.view(func(data *storedData) {
+				if _, ok := data.Chats[oldChatID]; ok {
+					t.Errorf("old group still has settings")
+				}
+			})
+		})
+	}
+}
+
+func TestBlockLimit(t *testing.T) {
+	telegram := newFakeTelegram(t)
+	d, _ := newTestDerpibooru(t)
+	useSites(t, d)
+	chatID := int64(400)
+	full := []string{}
+	for i := 0; i < maxChatBlockedTags-1; i++ {
+		full = append(full, fmt.Sprintf("tag%03d", i))
+	}
+	err := bot.chats.update(chatID, func(settings *chatSettings) {
+		settings.BlockedTags = full
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bot.chats.update(chatID, func(settings *chatSettings) {
+			settings.BlockedTags = nil
+		})
+	})
+
+	tests := []struct {
+		text     string
+		expected string
+		count    int // blocked tags after the command
+	}{
+		{"/block spider, tag000, worm", "Sorry, a chat can't block more than 100 tags and 99 are blocked already, so none of these were blocked.", 99},
+		{"/block spider, tag000", "Blocked: spider, tag000", 100},
+	}
+	for _, test := range tests {
+		handleUpdate(context.Background(), testMessage(chatID, test.text))
+		calls := telegram.called("sendMessage")
+		if got := calls[len(calls)-1].params.Get("text"); got != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.text, got, test.expected)
+		}
+		if got := len(chatBlockedTags(chatID)); got != test.count {
+			t.Errorf("%s: %d tags are blocked, expected %d", test.text, got, test.count)
+		}
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	d := newDerpibooru("", nil)
+	if got := d.splitTags(" Twilight Sparkle,, solo "); len(got) != 2 || got[0] != "twilight sparkle" || got[1] != "solo" {
+		t.Fatalf("unexpected derpibooru tags %q", got)
+	}
+	e := newE621(nil)
+	if got := e.splitTags(" Canine  solo "); len(got) != 2 || got[0] != "canine" || got[1] != "solo" {
+		t.Fatalf("unexpected e621 tags %q", got)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	telegram := newFakeTelegram(t)
+	d, server := newTestDerpibooru(t)
+	d.filterID = 100073
+	useSites(t, d)
+	chatID := int64(200)
+
+	tests := []struct {
+		text     string
+		reply    string // start of the reply
+		filterID string // filter_id that /pony sends afterwards
+	}{
+		{"/filter", "Filters on derpibooru:\n\n100073: Default\n56027: Everything\n37431: Legacy Default\n\nThis chat uses the default filter.", "100073"},
+		{"/filter everything", "Done, this chat now uses Everything on derpibooru.", "56027"},
+		{"/filter", "Filters on derpibooru:\n\n100073: Default\n56027: Everything (used in this chat)", "56027"},
+		{"/filter 12345", "Done, this chat now uses filter 12345 on derpibooru.", "12345"},
+		{"/filter nonexistent", "Sorry, there's no filter \"nonexistent\" on derpibooru", "12345"},
+		{"/filter default", "Done, this chat now uses the default filter on derpibooru.", "100073"},
+	}
+	for _, test := range tests {
+		handleUpdate(context.Background(), testMessage(chatID, test.text))
+		messages := telegram.called("sendMessage")
+		if len(messages) == 0 {
+			t.Fatalf("%q: got no reply", test.text)
+		}
+		if reply := messages[len(messages)-1].params.Get("text"); !strings.HasPrefix(reply, test.reply) {
+			t.Errorf("%q: reply is %q, expected it to start with %q", test.text, reply, test.reply)
+		}
+
+		// the same search with the same filter would come from the cache
+		cache.Purge()
+		handleUpdate(context.Background(), testMessage(chatID, "/pony fluttershy"))
+		if got := server.lastQuery().Get("filter_id"); got != test.filterID {
+			t.Errorf("after %q search used filter_id %q, expected %q", test.text, got, test.filterID)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,56 +14,186 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
-	"sort"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf16"
 
 	// "github.com/bradfitz/gomemcache/memcache"
-	rate "github.com/beefsack/go-rate"
-	"github.com/bluele/gcache"
 	"github.com/davecgh/go-spew/spew"
 	"gopkg.in/yaml.v2"
 )
 
 type telegramBot struct {
-	Token         string   `yaml:"telegram_token"`
-	DerpibooruKey string   `yaml:"derpibooru_key"`
-	BlockedTags   []string `yaml:"blocked_tags"`
-
+	Token         string `yaml:"telegram_token"`
+	Backend       string `yaml:"backend"` // "derpibooru" (default) or "e621"
+	DerpibooruKey string `yaml:"derpibooru_key"`
+	// derpibooru filter used in chats that didn't pick one with /filter, user's default filter if not set
+	DerpibooruFilterID int      `yaml:"derpibooru_filter_id"`
+	BlockedTags        []string `yaml:"blocked_tags"`
+
+	// telegram bot API, e.g. a local telegram-bot-api server, https://api.telegram.org by default
+	APIURL string `yaml:"telegram_api_url"`
+	// booru the backend talks to, e.g. a mirror running the same software, the backend's own site by default
+	BooruURL string `yaml:"booru_url"`
+	// more philomena boorus next to derpibooru, picked with /pony site:name or per chat with /site
+	PhilomenaSites []philomenaSite `yaml:"philomena_sites"`
+
+	// webhook mode is used instead of getUpdates if webhook_listen is set
+	WebhookListen string `yaml:"webhook_listen"` // address to listen on, e.g. 127.0.0.1:8080
+	WebhookURL    string `yaml:"webhook_url"`    // public URL telegram will post to, without the path
+	WebhookPath   string `yaml:"webhook_path"`   // secret path component, appended to webhook_url
+	WebhookSecret string `yaml:"webhook_secret"` // sent back by telegram in X-Telegram-Bot-Api-Secret-Token
+
+	// updates are handled by a fixed pool of workers with a bounded queue
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue_size"`
+	// if set, expvar metrics like queue_depth are served on http://metrics_listen/debug/vars
+	MetricsListen string `yaml:"metrics_listen"`
+	// how long to wait for handlers on SIGINT/SIGTERM before cancelling them, in seconds
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+	// how many recently sent images per chat searches avoid repeating, and for how long in seconds
+	HistorySize int `yaml:"history_size"`
+	HistoryTTL  int `yaml:"history_ttl"`
+	// most images one command sends as an album in chats where admins didn't choose, 5 by default
+	AlbumLimit int `yaml:"album_limit"`
+
+	// highest rating allowed in chats where admins didn't choose one, "explicit" by default
+	DefaultMaxRating string `yaml:"default_max_rating"`
+	// where chat settings, history and the update offset are kept, defaults to config file name with .data.json
+	DataFile string `yaml:"data_file"`
+	// older versions kept chat settings and the update offset in these files, they're imported into an empty data_file
+	// default to config file name with .chats.json and .state.json
+	ChatsFile string `yaml:"chats_file"`
+	StateFile string `yaml:"state_file"`
+
+	backend           booru
+	sites             map[string]booru // every booru the bot can use by name, backend is one of them
+	tracker           *updateTracker
+	store             storage
+	chats             *chatStore
+	pool              *workerPool
 	lastKnownUpdateID int64
 }
 
 type telegramResponse struct {
-	OK          bool            `json:"ok"`
-	Result      json.RawMessage `json:"result"`
-	ErrorCode   int             `json:"error_code"`
-	Description string          `json:"description"`
+	OK          bool                       `json:"ok"`
+	Result      json.RawMessage            `json:"result"`
+	ErrorCode   int                        `json:"error_code"`
+	Description string                     `json:"description"`
+	Parameters  telegramResponseParameters `json:"parameters"`
+}
+
+type telegramResponseParameters struct {
+	MigrateToChatID int64 `json:"migrate_to_chat_id"`
+	RetryAfter      int   `json:"retry_after"` // in seconds
 }
 
 type telegramUpdate struct {
 	// fields we're not interested in are not here
-	ID          int64                `json:"update_id"`
-	Message     *telegramMessage     `json:"message"`
-	InlineQuery *telegramInlineQuery `json:"inline_query"`
+	ID            int64                  `json:"update_id"`
+	Message       *telegramMessage       `json:"message"`
+	InlineQuery   *telegramInlineQuery   `json:"inline_query"`
+	CallbackQuery *telegramCallbackQuery `json:"callback_query"`
 }
 
 type telegramMessage struct {
 	// fields we're not interested in are not here
-	ID   int64 `json:"message_id"`
-	From *telegramUser
-	Date telegramDate
-	Chat telegramChat
-	Text string
+	ID         int64 `json:"message_id"`
+	From       *telegramUser
+	SenderChat *telegramChat `json:"sender_chat"` // set when anonymous group admin writes on behalf of the group
+	Date       telegramDate
+	Chat       telegramChat
+	Text       string
+	Entities   []telegramMessageEntity
+	Photo      []telegramPhotoSize // sizes of the same photo, biggest last
+	Document   *telegramDocument
+	// message this one replies to, telegram doesn't fill in its own reply_to_message
+	ReplyToMessage *telegramMessage `json:"reply_to_message"`
+	Caption        string
+	ReplyMarkup    *telegramInlineKeyboardMarkup `json:"reply_markup"`
+	// service messages about a group upgraded to a supergroup, sent to both of them
+	MigrateToChatID   int64 `json:"migrate_to_chat_id"`
+	MigrateFromChatID int64 `json:"migrate_from_chat_id"`
+}
+
+// telegramMessageEntity is a special part of the message text, like a link or a mention
+type telegramMessageEntity struct {
+	Type   string // e.g. "url", "text_link" or "bot_command"
+	Offset int    // in UTF-16 code units
+	Length int    // in UTF-16 code units
+	URL    string // only for "text_link"
 }
 
 type telegramDate time.Time
 
 type telegramInlineQuery struct {
-	ID     string
-	From   *telegramUser
-	Query  string
-	Offset string
+	ID       string
+	From     *telegramUser
+	Query    string
+	Offset   string
+	ChatType string `json:"chat_type"`
+}
+
+type telegramPhotoSize struct {
+	// fields we're not interested in are not here
+	FileID   string `json:"file_id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FileSize int64  `json:"file_size"`
+}
+
+type telegramDocument struct {
+	// fields we're not interested in are not here
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
+}
+
+type telegramFile struct {
+	// fields we're not interested in are not here
+	FileID   string `json:"file_id"`
+	FilePath string `json:"file_path"` // valid for at least an hour after getFile
+}
+
+// telegramCallbackQuery is sent when someone presses a button under a message of the bot
+type telegramCallbackQuery struct {
+	// fields we're not interested in are not here
+	ID      string           `json:"id"`
+	From    *telegramUser    `json:"from"`
+	Message *telegramMessage `json:"message"` // the message with the button, nil if it's too old
+	Data    string           `json:"data"`    // callback_data of the button
+}
+
+type telegramInlineKeyboardMarkup struct {
+	InlineKeyboard [][]telegramInlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type telegramInlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"` // up to 64 bytes
+}
+
+// telegramInputMedia is an item of an album for sendMediaGroup
+type telegramInputMedia struct {
+	Type       string `json:"type"` // "photo", "video" or "document"
+	Media      string `json:"media"`
+	Caption    string `json:"caption,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	HasSpoiler bool   `json:"has_spoiler,omitempty"`
+}
+
+type telegramChatMember struct {
+	// fields we're not interested in are not here
+	Status string `json:"status"` // "creator", "administrator", "member", "restricted", "left" or "kicked"
+	User   *telegramUser
 }
 
 type telegramInlineQueryResult struct {
@@ -70,6 +203,9 @@ type telegramInlineQueryResult struct {
 	Gif_URL      string `json:"gif_url,omitempty"`
 	Gif_Width    int    `json:"gif_width,omitempty"`
 	Gif_Height   int    `json:"gif_height,omitempty"`
+	Mpeg4_URL    string `json:"mpeg4_url,omitempty"`
+	Mpeg4_Width  int    `json:"mpeg4_width,omitempty"`
+	Mpeg4_Height int    `json:"mpeg4_height,omitempty"`
 	Thumb_URL    string `json:"thumb_url,omitempty"`
 	Photo_Width  int    `json:"photo_width,omitempty"`
 	Photo_Height int    `json:"photo_height,omitempty"`
@@ -78,6 +214,11 @@ type telegramInlineQueryResult struct {
 	Caption      string `json:"caption,omitempty"`
 }
 
+type telegramInlineQueryResultsButton struct {
+	Text           string `json:"text"`
+	StartParameter string `json:"start_parameter"`
+}
+
 type telegramUser struct {
 	// fields we're not interested in are not here
 	ID           int64  `json:"id"`
@@ -99,96 +240,279 @@ type telegramChat struct {
 	Description string `json:"description"`
 }
 
-// empty struct is ready to use
-type mimeValues struct {
-	writer *multipart.Writer
-	bb     *bytes.Buffer
-}
-
-type derpiEntry struct {
-	// fields we're not interested in are not here
-	ID              int64
-	Width           int
-	Height          int
-	Original_format string
-	Score           int64
-	Representations map[string]string
-}
-
 var (
-	bot   telegramBot
-	cache = gcache.New(100).LRU().Expiration(cacheDuration * time.Second).Build()
-	rl    = rate.New(maxRPS, time.Second)
+	bot telegramBot
 )
 
 const (
-	helloMessage  = "Hello! I'm a bot by @hmage that sends ponies from derpibooru.org.\n\nTo get a random top scoring picture: /pony\n\nTo get best recent picture with Celestia: /pony Celestia\n\nTo get random recent picture with Celestia: /randpony Celestia\n\nYou get the idea :)"
+	userAgent     = "Derpibooru and E621 Telegram Bot/0.2 (http://github.com/hmage/derpibooru_bot)"
 	cacheDuration = 600 // in seconds
-	maxRPS        = 10  // requests per second
+
+	maxInlineResults = 50 // telegram doesn't allow more results per inline query answer
+
+	defaultShutdownTimeout = 30 // in seconds
+	defaultHistorySize     = 50
+	defaultHistoryTTL      = 24 * 60 * 60 // in seconds
+	defaultAlbumLimit      = 5
 )
 
-var messageHandlers = map[string]func(telegramUpdate) error{
-	"hello":    handleHello,
-	"help":     handleHello,
-	"start":    handleHello,
-	"pony":     handlePony,
-	"randpony": handleRandPony,
-	"clop":     handleClop,
-	"randclop": handleRandClop,
+// backend-specific commands are added by readConfig()
+var messageHandlers = map[string]func(context.Context, telegramUpdate) error{
+	"hello":     handleHello,
+	"help":      handleHello,
+	"start":     handleHello,
+	"settings":  handleSettings,
+	"block":     handleBlock,
+	"unblock":   handleUnblock,
+	"blocklist": handleBlocklist,
+	"site":      handleSite,
+	"filter":    handleFilter,
+	"source":    handleSource,
+	"more":      handleMore,
+	"next":      handleMore,
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	err := readConfig("settings.yaml")
+	configFile := "settings.yaml"
+	if len(os.Args) > 1 {
+		configFile = os.Args[1]
+	}
+	err := readConfig(configFile)
+	if err != nil {
+		panic(err)
+	}
+	store, err := openFileStorage(bot.DataFile, storageFlushDelay)
+	if err != nil {
+		panic(err)
+	}
+	err = importLegacyFiles(store, bot.ChatsFile, bot.StateFile)
 	if err != nil {
 		panic(err)
 	}
-	for {
-		updates, err := bot.getUpdates()
+	bot.tracker = loadUpdateTracker(store)
+	bot.lastKnownUpdateID = bot.tracker.lastHandled()
+	bot.store = store
+	bot.chats = newChatStore(store)
+
+	// ctx is cancelled on SIGINT/SIGTERM and stops receiving updates,
+	// handlersCtx is cancelled only if handlers didn't finish in time
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	handlersCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+
+	bot.pool = newWorkerPool(bot.Workers, bot.QueueSize, func(update telegramUpdate) {
+		processUpdate(handlersCtx, update)
+	})
+	if pending := bot.tracker.pending(); len(pending) > 0 {
+		log.Printf("Replaying %d updates that weren't handled before restart", len(pending))
+		for _, update := range pending {
+			bot.pool.submit(update)
+		}
+	}
+	expvar.Publish("queue_depth", expvar.Func(func() interface{} { return bot.pool.depth() }))
+	if bot.MetricsListen != "" {
+		go func() {
+			log.Printf("Serving metrics on %s", bot.MetricsListen)
+			err := http.ListenAndServe(bot.MetricsListen, expvar.Handler())
+			log.Printf("Metrics server failed: %s", err)
+		}()
+	}
+
+	if bot.WebhookListen != "" {
+		err = bot.runWebhook(ctx)
+	} else {
+		bot.poll(ctx)
+	}
+	log.Printf("Stopped receiving updates, waiting up to %s for handlers to finish", bot.shutdownTimeout())
+	bot.drain(cancelHandlers)
+	flushErr := store.flush()
+	if flushErr != nil {
+		log.Printf("Failed to save data to %s: %s", bot.DataFile, flushErr)
+	}
+	if bot.WebhookListen == "" {
+		bot.confirmUpdates()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Shut down cleanly")
+}
+
+// poll receives updates with getUpdates until ctx is cancelled
+func (b *telegramBot) poll(ctx context.Context) {
+	failures := 0
+	for ctx.Err() == nil {
+		updates, err := b.getUpdates(ctx)
+		if err != nil && ctx.Err() != nil {
+			// we're shutting down, request was interrupted
+			return
+		}
 		if err != nil {
+			failures++
+			retryAfter := 0
+			var tgErr *telegramError
+			if errors.As(err, &tgErr) {
+				retryAfter = tgErr.parameters.RetryAfter
+			}
+			delay := retryDelay(failures, retryAfter)
 			log.Printf("Got an error when getting updates: %s", err)
-			log.Printf("Failed to get updates, will retry in one second")
-			time.Sleep(time.Second)
+			log.Printf("Failed to get updates, will retry in %s", delay)
+			sleepContext(ctx, delay)
 			continue
 		}
+		failures = 0
 		if len(updates) == 0 {
 			// nothing to do, move on
 			continue
 		}
 		for _, update := range updates {
-			go func(update telegramUpdate) {
-				// log each update
-				logUpdate(update)
-
-				if update.InlineQuery != nil {
-					log.Printf("Got inline query: %s", spew.Sdump(update))
-					err := inlineHandler(update)
-					if err != nil {
-						replyErrorAndLog(update, "Failed to handle inline query: %s", err)
-						return
-					}
-				}
-
-				if update.Message != nil {
-					command := update.Message.Command()
-					if command == "" {
-						// log.Printf("Got a message without command: %s", spew.Sdump(update))
-						return
-					}
-					log.Printf("got command from %s: %s", update.Message.From.Username, command)
-					messageHandler, ok := messageHandlers[command]
-					if !ok {
-						log.Printf("Got unknown command %s", command)
-						return
-					}
-					err := messageHandler(update)
-					if err != nil {
-						replyErrorAndLog(update, "Failed to handle command %s: %s", command, err)
-						return
-					}
-				}
-
-			}(update)
+			dispatchUpdate(update)
+		}
+		// the next poll tells telegram that these were received, they must be on disk by then to be replayed after a crash
+		err = b.store.flush()
+		if err != nil {
+			log.Printf("Failed to save received updates: %s", err)
+		}
+	}
+}
+
+// drain waits for queued and running handlers, cancelling them if they take longer than shutdown_timeout
+func (b *telegramBot) drain(cancelHandlers context.CancelFunc) {
+	timer := time.AfterFunc(b.shutdownTimeout(), func() {
+		log.Printf("Handlers didn't finish in %s, cancelling them", b.shutdownTimeout())
+		cancelHandlers()
+	})
+	defer timer.Stop()
+	b.pool.stop()
+}
+
+func (b *telegramBot) shutdownTimeout() time.Duration {
+	if b.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout * time.Second
+	}
+	return time.Duration(b.ShutdownTimeout) * time.Second
+}
+
+// confirmUpdates tells telegram which updates were received, so they're not re-sent after restart,
+// ones that weren't handled yet are saved by the tracker and replayed from there
+func (b *telegramBot) confirmUpdates() {
+	offset := b.lastKnownUpdateID
+	if offset == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	params := url.Values{}
+	params.Add("offset", strconv.FormatInt(offset+1, 10))
+	params.Add("limit", "1")
+	params.Add("timeout", "0")
+	_, err := b.callGetUpdates(ctx, params)
+	if err != nil {
+		log.Printf("Failed to confirm offset %d with telegram: %s", offset+1, err)
+	}
+}
+
+// dispatchUpdate queues the update for workers, unless it was already handled before or is being handled now
+func dispatchUpdate(update telegramUpdate) {
+	if bot.tracker != nil && !bot.tracker.start(update) {
+		log.Printf("Skipping update %d, it was already handled", update.ID)
+		return
+	}
+	if !bot.pool.submit(update) {
+		// the tracker keeps it in the state to be handled after restart
+		log.Printf("Not handling update %d, shutting down", update.ID)
+	}
+}
+
+// processUpdate is run by workers for every update that was dispatched
+func processUpdate(ctx context.Context, update telegramUpdate) {
+	if ctx.Err() != nil {
+		// shutdown cancelled handlers, updates left in the queue are handled after restart
+		log.Printf("Not handling update %d, shutting down", update.ID)
+		return
+	}
+	recoverHandler(ctx, update)
+	if bot.tracker == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		// the handler was interrupted, it's not marked handled so telegram sends it again after restart
+		log.Printf("Update %d was interrupted by shutdown", update.ID)
+		return
+	}
+	err := bot.tracker.finish(update.ID)
+	if err != nil {
+		log.Printf("Failed to save state after update %d: %s", update.ID, err)
+	}
+}
+
+// recoverHandler handles the update and logs a panic instead of crashing,
+// a panicking update is then marked handled, otherwise it would be replayed after every restart
+func recoverHandler(ctx context.Context, update telegramUpdate) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Handler of update %d panicked: %v\n%s", update.ID, r, debug.Stack())
+		}
+	}()
+	handleUpdate(ctx, update)
+}
+
+// handleUpdate dispatches a single update, no matter if it came from polling or webhook
+func handleUpdate(ctx context.Context, update telegramUpdate) {
+	// log each update
+	logUpdate(update)
+
+	if update.InlineQuery != nil {
+		log.Printf("Got inline query: %s", spew.Sdump(update))
+		err := inlineHandler(ctx, update)
+		if err != nil {
+			replyErrorAndLog(ctx, update, "Failed to handle inline query: %s", err)
+			return
+		}
+	}
+
+	if update.CallbackQuery != nil {
+		err := handleCallback(ctx, update)
+		if err != nil {
+			log.Printf("Failed to handle button %q: %s", update.CallbackQuery.Data, err)
+		}
+	}
+
+	if update.Message != nil && (update.Message.MigrateToChatID != 0 || update.Message.MigrateFromChatID != 0) {
+		oldChatID, newChatID := update.Message.Chat.ID, update.Message.MigrateToChatID
+		if newChatID == 0 {
+			oldChatID, newChatID = update.Message.MigrateFromChatID, update.Message.Chat.ID
+		}
+		err := migrateChat(oldChatID, newChatID)
+		if err != nil {
+			log.Printf("Failed to move chat %d to %d: %s", oldChatID, newChatID, err)
+		}
+		return
+	}
+
+	if update.Message != nil {
+		command := update.Message.Command()
+		if command == "" {
+			// log.Printf("Got a message without command: %s", spew.Sdump(update))
+			err := handleLinks(ctx, update)
+			if err != nil {
+				// nobody asked the bot, so don't bother the chat with errors
+				log.Printf("Failed to preview links: %s", err)
+			}
+			return
+		}
+		log.Printf("got command from %s: %s", update.Message.From.Username, command)
+		messageHandler, ok := messageHandlers[command]
+		if !ok {
+			log.Printf("Got unknown command %s", command)
+			return
+		}
+		err := messageHandler(ctx, update)
+		if err != nil {
+			replyErrorAndLog(ctx, update, "Failed to handle command %s: %s", command, err)
+			return
 		}
 	}
 }
@@ -196,7 +520,7 @@ func main() {
 func readConfig(filename string) error {
 	body, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	err = yaml.Unmarshal(body, &bot)
@@ -208,8 +532,91 @@ func readConfig(filename string) error {
 		return fmt.Errorf("Got an empty telegram token")
 	}
 
-	if bot.DerpibooruKey == "" {
-		return fmt.Errorf("Got an empty derpibooru key")
+	if bot.APIURL != "" {
+		_, err = parseBaseURL(bot.APIURL)
+		if err != nil {
+			return fmt.Errorf("Invalid telegram_api_url: %w", err)
+		}
+	}
+	var booruURL *url.URL
+	if bot.BooruURL != "" {
+		booruURL, err = parseBaseURL(bot.BooruURL)
+		if err != nil {
+			return fmt.Errorf("Invalid booru_url: %w", err)
+		}
+	}
+
+	switch bot.Backend {
+	case "", "derpibooru":
+		if bot.DerpibooruKey == "" {
+			return fmt.Errorf("Got an empty derpibooru key")
+		}
+		d := newDerpibooru(bot.DerpibooruKey, bot.BlockedTags)
+		if booruURL != nil {
+			d.baseURL = *booruURL
+		}
+		d.filterID = bot.DerpibooruFilterID
+		bot.backend = d
+		bot.sites = map[string]booru{d.name: d}
+		for _, site := range bot.PhilomenaSites {
+			if !isValidSiteName(site.Name) {
+				return fmt.Errorf("Name of philomena site %q must be lowercase letters and digits", site.Name)
+			}
+			if _, ok := bot.sites[site.Name]; ok {
+				return fmt.Errorf("There's more than one philomena site named %q", site.Name)
+			}
+			siteURL, err := parseBaseURL(site.URL)
+			if err != nil {
+				return fmt.Errorf("Invalid url of philomena site %q: %w", site.Name, err)
+			}
+			p := newPhilomena(site.Name, *siteURL, site.Key, bot.BlockedTags)
+			p.filterID = site.FilterID
+			if site.PonyAliases {
+				p.tagAliases = derpibooruTagAliases
+			}
+			bot.sites[site.Name] = p
+		}
+	case "e621":
+		if len(bot.PhilomenaSites) > 0 {
+			return fmt.Errorf("philomena_sites only work with derpibooru backend")
+		}
+		e := newE621(bot.BlockedTags)
+		if booruURL != nil {
+			e.baseURL = *booruURL
+		}
+		bot.backend = e
+		bot.sites = map[string]booru{"e621": e}
+	default:
+		return fmt.Errorf("Unknown backend %q", bot.Backend)
+	}
+
+	if bot.WebhookListen != "" {
+		if bot.WebhookURL == "" {
+			return fmt.Errorf("Got an empty webhook_url while webhook_listen is set")
+		}
+		if bot.WebhookPath == "" {
+			return fmt.Errorf("Got an empty webhook_path while webhook_listen is set")
+		}
+		if !isValidSecretToken(bot.WebhookSecret) {
+			return fmt.Errorf("webhook_secret must be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+		}
+	}
+
+	if bot.DataFile == "" {
+		bot.DataFile = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".data.json"
+	}
+	if bot.StateFile == "" {
+		bot.StateFile = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".state.json"
+	}
+	if bot.ChatsFile == "" {
+		bot.ChatsFile = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".chats.json"
+	}
+	if bot.DefaultMaxRating != "" && ratingLevel(bot.DefaultMaxRating) == -1 {
+		return fmt.Errorf("default_max_rating must be one of %s", strings.Join(ratings, ", "))
+	}
+
+	for command, handler := range bot.backend.commands() {
+		messageHandlers[command] = handler
 	}
 
 	return nil
@@ -222,53 +629,84 @@ func logUpdate(update telegramUpdate) {
 	if update.InlineQuery != nil {
 		log.Printf("%#v", update.InlineQuery)
 	}
+	if update.CallbackQuery != nil {
+		log.Printf("%#v", update.CallbackQuery)
+	}
 }
 
-func (b *telegramBot) getUpdates() ([]telegramUpdate, error) {
+func (b *telegramBot) getUpdates(ctx context.Context) ([]telegramUpdate, error) {
 	// trace("called")
 	params := url.Values{}
 	if b.lastKnownUpdateID != 0 {
 		params.Add("offset", strconv.FormatInt(b.lastKnownUpdateID+1, 10))
 	}
 	params.Add("timeout", "20")
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/%s", b.Token, "getUpdates")
-	resp, err := http.PostForm(url, params)
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
-	}
+	updates, err := b.callGetUpdates(ctx, params)
 	if err != nil {
 		return nil, err
 	}
 
-	response := &telegramResponse{}
-	err = json.NewDecoder(resp.Body).Decode(response)
+	// update last known ID, otherwise server will send the same messages again and again
+	// also, it might reset to random value after inactivity, do not assume it is always increasing between requests
+	if len(updates) == 0 {
+		return updates, nil
+	}
+	var largestID int64
+	for _, update := range updates {
+		if update.ID > largestID {
+			largestID = update.ID
+		}
+	}
+
+	b.lastKnownUpdateID = largestID
+
+	return updates, nil
+}
+
+// methodURL is where telegram bot API method is called
+func (b *telegramBot) methodURL(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", b.apiURL(), b.Token, method)
+}
+
+// fileURL is where telegram serves the file from getFile
+func (b *telegramBot) fileURL(filePath string) string {
+	return fmt.Sprintf("%s/file/bot%s/%s", b.apiURL(), b.Token, filePath)
+}
+
+func (b *telegramBot) apiURL() string {
+	if b.APIURL == "" {
+		return "https://api.telegram.org"
+	}
+	return strings.TrimSuffix(b.APIURL, "/")
+}
+
+func (b *telegramBot) callGetUpdates(ctx context.Context, params url.Values) ([]telegramUpdate, error) {
+	url := b.methodURL("getUpdates")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(params.Encode()))
 	if err != nil {
 		return nil, err
 	}
-
-	if !response.OK {
-		// spew.Dump(response)
-		err := fmt.Errorf("Telegram said it's not OK: %d %s", response.ErrorCode, response.Description)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	var updates []telegramUpdate
-	err = json.Unmarshal(response.Result, &updates)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	// update last known ID, otherwise server will send the same messages again and again
-	// also, it might reset to random value after inactivity, do not assume it is always increasing between requests
-	var largestID int64
-	for _, update := range updates {
-		if update.ID > largestID {
-			largestID = update.ID
-		}
+	var updates []telegramUpdate
+	err = parseTelegramResponse(resp, body, &updates)
+	if err != nil {
+		return nil, err
 	}
 
-	b.lastKnownUpdateID = largestID
-
 	return updates, nil
 }
 
@@ -294,6 +732,48 @@ func (m *telegramMessage) Command() string {
 	return command                     // remove slash in the beginning
 }
 
+// Links returns links in the message, both visible ones and ones behind text
+func (m *telegramMessage) Links() []string {
+	text := utf16.Encode([]rune(m.Text))
+	links := []string{}
+	for _, entity := range m.Entities {
+		switch entity.Type {
+		case "text_link":
+			links = append(links, entity.URL)
+		case "url":
+			if entity.Offset < 0 || entity.Length < 0 || entity.Offset+entity.Length > len(text) {
+				continue
+			}
+			links = append(links, string(utf16.Decode(text[entity.Offset:entity.Offset+entity.Length])))
+		}
+	}
+	return links
+}
+
+// Image returns the file ID of the photo in the message, or of the document if it is an image
+func (m *telegramMessage) Image() (fileID string, filename string, ok bool) {
+	if len(m.Photo) > 0 {
+		return m.Photo[len(m.Photo)-1].FileID, "photo.jpg", true
+	}
+	if m.Document != nil && strings.HasPrefix(m.Document.MimeType, "image/") {
+		return m.Document.FileID, m.Document.FileName, true
+	}
+	return "", "", false
+}
+
+// CommandTarget is what comes after @ in the command, lowercased, e.g. bot's username or a site name
+func (m *telegramMessage) CommandTarget() string {
+	if m.Text == "" || m.Text[0] != '/' {
+		return ""
+	}
+	command := strings.Fields(m.Text)[0]
+	i := strings.Index(command, "@")
+	if i == -1 {
+		return ""
+	}
+	return strings.ToLower(command[i+1:])
+}
+
 func (m *telegramMessage) CommandOptions() string {
 	if m.Text == "" {
 		return ""
@@ -311,55 +791,91 @@ func (m *telegramMessage) CommandOptions() string {
 	return m.Text[len(command)+1:]
 }
 
-//
 // bot inline handler
-//
-func inlineHandler(update telegramUpdate) error {
-	limiter := "safe"
-	search := update.InlineQuery.Query
-	switch {
-	case strings.Contains(search, "explicit"):
-		limiter = "explicit"
-	case strings.Contains(search, "suggestive"):
-		limiter = "suggestive"
+func inlineHandler(ctx context.Context, update telegramUpdate) error {
+	// there's no chat for inline queries, so the site of user's private chat with the bot is used
+	backend, ok := chatSite(update.InlineQuery.From.ID).(inlineBooru)
+	if !ok {
+		// backend can't do inline queries, ignore them
+		return nil
 	}
-	entries, err := getImages(search, limiter)
+	search := update.InlineQuery.Query
+	node, err := backend.parseQuery(search)
+	if err != nil {
+		return refuseInline(ctx, update, "Can't understand the search: "+err.Error())
+	}
+	// there's no chat for inline queries, so settings of user's private chat with the bot apply
+	maxRating := chatMaxRating(update.InlineQuery.From.ID)
+	// ratings typed by the user are already in the search, the ceiling takes care of the rest,
+	// safe is the default when the search doesn't ask for any rating
+	rating := "safe"
+	if requested := requestedRating(node); requested != "" {
+		if !ratingAllowed(requested, maxRating) {
+			return refuseInline(ctx, update, fmt.Sprintf("Only images up to %s are allowed", maxRating))
+		}
+		rating = ""
+	} else if requestsContentRating(node) {
+		// grimdark images can have any rating, so the ceiling picks which ones
+		rating = ""
+	}
+	query := booruQuery{
+		search:      search,
+		rating:      rating,
+		maxRating:   maxRating,
+		blockedTags: chatBlockedTags(update.InlineQuery.From.ID),
+		filterID:    chatFilterID(update.InlineQuery.From.ID, siteName(backend)),
+		// no more than 50 results per query are allowed, so every page of results is one page from booru
+		page:    parseInlineOffset(update.InlineQuery.Offset),
+		perPage: maxInlineResults,
+	}
+	entries, more, err := getImages(ctx, backend, query)
 	if err != nil {
 		return fmt.Errorf("Failed to get images with search %q: %w", search, err)
 	}
+	if len(entries) > maxInlineResults {
+		entries = entries[:maxInlineResults]
+	}
+	// telegram asks for the next page with next_offset once user scrolls to the end, empty one means there's no more.
+	// the page may have nothing to show after filtering, but pages after it still can
+	nextOffset := ""
+	if more {
+		nextOffset = strconv.Itoa(query.page + 1)
+	}
+
 	params := mimeValues{}
 	params.Add("inline_query_id", update.InlineQuery.ID)
 	results := []telegramInlineQueryResult{}
-	for i, entry := range entries {
-		if i >= 50 {
-			// no more than 50 results per query are allowed
-			break
-		}
-		photoURL, err := url.Parse(entry.Representations["tall"])
-		if err != nil {
-			return fmt.Errorf("Failed parsing photo URL: %w", err)
-		}
-		photoURL.Scheme = "https"
-		thumbURL, err := url.Parse(entry.Representations["thumb"])
+	for _, entry := range entries {
+		media, err := backend.inlineMedia(entry)
 		if err != nil {
-			return fmt.Errorf("Failed parsing thumb URL: %w", err)
+			return err
 		}
-		thumbURL.Scheme = "https"
 		result := telegramInlineQueryResult{
-			ID:        strconv.FormatInt(entry.ID, 10),
-			Thumb_URL: thumbURL.String(),
-			Caption:   fmt.Sprintf("https://derpibooru.org/%d", entry.ID),
+			ID:        strconv.FormatInt(entry.postID(), 10),
+			Thumb_URL: media.thumbURL.String(),
+			Caption:   backend.postURL(entry.postID()),
 		}
-		if strings.HasSuffix(entry.Representations["tall"], ".gif") {
+		switch media.kind {
+		case "animation":
+			if strings.HasSuffix(media.url.Path, ".mp4") {
+				result.Type = "mpeg4_gif"
+				result.Mpeg4_URL = media.url.String()
+				result.Mpeg4_Width = media.width
+				result.Mpeg4_Height = media.height
+				break
+			}
 			result.Type = "gif"
-			result.Gif_URL = photoURL.String()
-			result.Gif_Width = entry.Width
-			result.Gif_Height = entry.Height
-		} else {
+			result.Gif_URL = media.url.String()
+			result.Gif_Width = media.width
+			result.Gif_Height = media.height
+		case "photo":
 			result.Type = "photo"
-			result.Photo_URL = photoURL.String()
-			result.Photo_Width = entry.Width
-			result.Photo_Height = entry.Height
+			result.Photo_URL = media.url.String()
+			result.Photo_Width = media.width
+			result.Photo_Height = media.height
+		default:
+			// telegram can't show it inline, skip
+			continue
 		}
 		results = append(results, result)
 	}
@@ -369,7 +885,8 @@ func inlineHandler(update telegramUpdate) error {
 	}
 	params.Add("results", string(resultsJSON))
 	params.Add("cache_time", 1)
-	err = bot.sendInternal("answerInlineQuery", params, update)
+	params.Add("next_offset", nextOffset)
+	err = bot.sendInternal(ctx, "answerInlineQuery", params, update)
 	if err != nil {
 		return fmt.Errorf("sendInternal failed: %w", err)
 	}
@@ -379,46 +896,54 @@ func inlineHandler(update telegramUpdate) error {
 // --------------------
 // bot command handlers
 // --------------------
-func handleHello(update telegramUpdate) error {
-	return bot.sendMessage(update, helloMessage)
-}
-
-func handlePony(update telegramUpdate) error {
-	return handleImage(update, "safe", false)
-}
-
-func handleRandPony(update telegramUpdate) error {
-	return handleImage(update, "safe", true)
-}
-
-func handleClop(update telegramUpdate) error {
-	return handleImage(update, "explicit", false)
-}
-
-func handleRandClop(update telegramUpdate) error {
-	return handleImage(update, "explicit", true)
+func handleHello(ctx context.Context, update telegramUpdate) error {
+	backend, _ := siteFor(update.Message)
+	return bot.sendMessage(ctx, update, backend.hello())
 }
 
-func handleImage(update telegramUpdate, limiter string, forceRandom bool) error {
+// handleImage replies with an image for the search in the message.
+// rating is the rating that the command asks for, empty means anything that the chat allows.
+// limiter is an extra tag that the command always adds to the search.
+func handleImage(ctx context.Context, update telegramUpdate, rating string, limiter string, forceRandom bool) error {
 	// trace("called")
-	err := bot.sendChatAction(update, "upload_photo")
+	maxRating := chatMaxRating(update.Message.Chat.ID)
+	if rating != "" && !ratingAllowed(rating, maxRating) {
+		return refuseRating(ctx, update, rating, maxRating)
+	}
+	backend, options := siteFor(update.Message)
+	search, count := splitCount(options)
+	if limit := chatAlbumLimit(update.Message.Chat.ID); count > limit {
+		count = limit
+	}
+	if site, id, ok := postRequest(backend, search); ok {
+		return handlePost(ctx, update, site, id, rating, limiter)
+	}
+	node, err := backend.parseQuery(search)
+	if err != nil {
+		return bot.sendMessage(ctx, update, "Sorry, I can't understand your search: "+err.Error())
+	}
+	if requested := requestedRating(node); requested != "" && !ratingAllowed(requested, maxRating) {
+		return refuseRating(ctx, update, requested, maxRating)
+	}
+
+	err = bot.sendChatAction(ctx, update, "upload_photo")
 	if err != nil {
 		return err
 	}
 
-	search := update.Message.CommandOptions()
 	isRandom := forceRandom || search == ""
 
-	// trace("getting images from derpibooru")
+	// trace("getting images from booru")
 	start := time.Now()
-	entries, err := getImages(search, limiter)
+	query := chatQuery(update.Message.Chat.ID, backend, search, limiter, rating)
+	entries, page, err := pickImages(ctx, backend, query, isRandom, update.Message.Chat.ID, count)
 	if err != nil {
 		return err
 	}
 	gotImages := time.Now()
-	trace("Got images from derpibooru in %s", gotImages.Sub(start))
+	trace("Got images from booru in %s", gotImages.Sub(start))
 	if len(entries) == 0 {
-		err = bot.sendMessage(update, "I am sorry, "+update.Message.From.FirstName+", got no images to reply with.")
+		err = bot.sendMessage(ctx, update, "I am sorry, "+update.Message.From.FirstName+", got no images to reply with.")
 		if err != nil {
 			return err
 		}
@@ -436,196 +961,193 @@ func handleImage(update telegramUpdate, limiter string, forceRandom bool) error
 	case search != "" && isRandom:
 		caption = "Random recent image for your search"
 	}
+	if len(entries) > 1 {
+		caption = strings.Replace(caption, "image", "images", 1)
+	}
 
-	entry := entries[0]
-	if isRandom {
-		entry = entries[rand.Intn(len(entries))]
+	last := lastSearch{
+		Site:    siteName(backend),
+		Search:  search,
+		Limiter: limiter,
+		Rating:  rating,
+		Random:  isRandom,
+		Page:    page,
 	}
-	imageURL, err := url.Parse(entry.Representations["tall"])
+	start = time.Now()
+	err = sendPosts(ctx, update, backend, entries, caption, &last)
 	if err != nil {
 		return err
 	}
-	if imageURL.Scheme == "" {
-		imageURL.Scheme = "https"
-	}
-
-	caption = fmt.Sprintf("https://derpibooru.org/%d\n%s", entry.ID, caption)
-	filename := fmt.Sprintf("%d.%s", entry.ID, entry.Original_format)
-
-	start = time.Now()
-	// If we have an mp4 representation, use it instead
-	if v, ok := entry.Representations["mp4"]; ok {
-		mp4URL, err := url.Parse(v)
-		if err != nil {
-			return err
-		}
-		err = bot.sendAnimation(update, mp4URL, filename, caption)
-		if err != nil {
-			return err
-		}
-	}
-	if entry.Original_format == "gif" {
-		err = bot.sendDocument(update, imageURL, filename, caption)
-		if err != nil {
-			return err
-		}
-	} else {
-		err = bot.sendPhoto(update, imageURL, filename, caption)
-		if err != nil {
-			return err
-		}
-	}
 	elapsed := time.Since(start)
 	trace("sending reply took %s", elapsed)
 
+	rememberSearch(update.Message, last)
 	return nil
 }
 
-func getImages(search, limiter string) ([]derpiEntry, error) {
-	url := url.URL{}
-	url.Scheme = "https"
-	url.Host = "derpibooru.org"
-	url.Path = "/api/v1/json/search/images"
-	query := url.Query()
-
-	q := []string{}
+// chatQuery is the search with the chat's rating ceiling, blocked tags and filter
+func chatQuery(chatID int64, backend booru, search, limiter, rating string) booruQuery {
+	return booruQuery{
+		search:      search,
+		limiter:     limiter,
+		rating:      rating,
+		maxRating:   chatMaxRating(chatID),
+		blockedTags: chatBlockedTags(chatID),
+		filterID:    chatFilterID(chatID, siteName(backend)),
+	}
+}
 
-	// if derpibooru key is set, use it
-	if bot.DerpibooruKey != "" {
-		query.Set("key", bot.DerpibooruKey)
+// postRequest recognizes a post number or a link to a post instead of a search.
+// Links are looked up on every site, so a link to another site is sent from there.
+func postRequest(backend booru, search string) (booru, int64, bool) {
+	search = strings.TrimSpace(search)
+	if id, ok := parsePostID(search); ok {
+		return backend, id, true
+	}
+	if strings.ContainsAny(search, " ,") {
+		return nil, 0, false
+	}
+	if !strings.HasPrefix(search, "http://") && !strings.HasPrefix(search, "https://") {
+		search = "https://" + search
+	}
+	u, err := url.Parse(search)
+	if err != nil || u.Host == "" {
+		return nil, 0, false
 	}
+	return sitePostURL(backend, u)
+}
 
-	tags := strings.Split(search, ",")
-	for _, tag := range tags {
-		tag = strings.TrimSpace(tag)
-		if tag == "" {
-			continue
+// sitePostURL finds the site that the link to a post points to, trying backend first
+func sitePostURL(backend booru, u *url.URL) (booru, int64, bool) {
+	sites := []booru{backend}
+	for _, name := range siteNames() {
+		sites = append(sites, bot.sites[name])
+	}
+	for _, site := range sites {
+		if id, ok := site.postIDFromURL(u); ok {
+			return site, id, true
 		}
-		q = append(q, strings.ToLower(tag))
 	}
+	return nil, 0, false
+}
 
-	// enforce limiter
-	if limiter == "" {
-		limiter = "safe"
+// handlePost replies with a single post, as long as it passes the same rules as search results would
+func handlePost(ctx context.Context, update telegramUpdate, backend booru, id int64, rating string, limiter string) error {
+	err := bot.sendChatAction(ctx, update, "upload_photo")
+	if err != nil {
+		return err
 	}
-	q = append(q, strings.ToLower(limiter))
 
-	// cache key must only use user input, so ignore rest
-	sort.Strings(q)
-	cacheKey := strings.Join(q, ", ")
-
-	// synthesize more query parameters based on settings
-	// enforce blocked tags
-	for _, tag := range bot.BlockedTags {
-		q = append(q, "-"+tag)
+	post, err := backend.getImage(ctx, id)
+	if errors.Is(err, errPostNotFound) {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, there's no post %d on %s that I could send.", id, siteName(backend)))
 	}
-
-	// if search is empty, we need top scoring ones in last 3 days
-	if search == "" {
-		// empty search, choose best in last 3 days
-		from := time.Now().Add(time.Hour * 24 * 3 * -1)
-		q = append(q, "created_at.gt:"+from.Format(time.RFC3339))
-		query.Set("sf", "score")
-		query.Set("sd", "desc")
+	if err != nil {
+		return err
 	}
 
-	// we have our search query, set it and encode into URL
-	sort.Strings(q)
-	query.Set("q", strings.Join(q, ", "))
-	url.RawQuery = query.Encode()
-	location := url.String()
-
-	// fetch the URL, cache to avoid re-fetching if possible
-	jsonBody, err := cachedGet(location, cacheKey)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get from URL %s: %w", location, err)
+	chatID := update.Message.Chat.ID
+	maxRating := chatMaxRating(chatID)
+	postRating := knownRating(post)
+	if !ratingAllowed(postRating, maxRating) {
+		return refuseRating(ctx, update, postRating, maxRating)
+	}
+	if rating != "" && postRating != rating {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, post %d is %s, and /%s only sends %s images.", id, postRating, update.Message.Command(), rating))
+	}
+	if limiter != "" && !containsString(post.postTags(), strings.ToLower(limiter)) {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, post %d isn't tagged %s.", id, strings.ToLower(limiter)))
+	}
+	if hasBlockedTags(post, chatID) {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, post %d has tags that are blocked in this chat.", id))
 	}
 
-	// parse json body
-	root := map[string]*json.RawMessage{}
-	err = json.Unmarshal(jsonBody, &root)
+	media, err := post.media()
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// now get actual images json
-	entries := []derpiEntry{}
-	parent := "images"
-	err = json.Unmarshal(*root[parent], &entries)
+	err = bot.sendMedia(ctx, update, media, backend.postURL(id)+"\nImage you asked for", imageButtons(update.Message, siteName(backend), id, false))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	rememberSent(chatID, siteName(backend), id)
+	return nil
+}
 
-	// sort by score
-	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Score > entries[j].Score })
+// knownRating is the rating of the post, posts without one are treated as the worst
+func knownRating(post booruPost) string {
+	if rating := post.postRating(); rating != "" {
+		return rating
+	}
+	return "explicit"
+}
 
-	return entries, nil
+// postAllowed reports whether the post can be sent to the chat: its rating is allowed and none of its tags are blocked
+func postAllowed(post booruPost, chatID int64) bool {
+	return ratingAllowed(knownRating(post), chatMaxRating(chatID)) && !hasBlockedTags(post, chatID)
 }
 
-// cache maps URL to []byte
-func cachedGet(location string, cacheKey string) ([]byte, error) {
-	// check cache
-	{
-		cached, err := cache.Get(cacheKey)
-		switch err {
-		case nil:
-			// found, return the data
-			cached, ok := cached.([]byte)
-			if ok {
-				// trace("Found key %s in cache: %d bytes", cacheKey, len(cached))
-				return cached, nil
-			}
-			log.Printf("SHOULD NOT HAPPEN -- fetched data from cache for key \"%s\" is not []byte!", cacheKey)
-		case gcache.KeyNotFoundError:
-			// do nothing, not found
-		default:
-			// log but continue working, cache might be down
-			log.Printf("Couldn't fetch data from cache for key \"%s\": %s", cacheKey, err)
+// hasBlockedTags reports whether the post has tags blocked in the chat or in the config
+func hasBlockedTags(post booruPost, chatID int64) bool {
+	tags := post.postTags()
+	for _, tag := range append(append([]string{}, chatBlockedTags(chatID)...), bot.BlockedTags...) {
+		if containsString(tags, strings.ToLower(tag)) {
+			return true
 		}
 	}
+	return false
+}
 
-	// ratelimit if neccessary
-	rl.Wait()
-	// fetch from network
-	resp, err := http.Get(location)
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
-	}
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't fetch url \"%s\": %s", location, err)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't read body of url \"%s\": %s", location, err)
+// getImages searches the booru, results are sorted best first
+func getImages(ctx context.Context, backend booru, query booruQuery) ([]booruPost, bool, error) {
+	return backend.search(ctx, query)
+}
+
+// siteFor picks the booru for the message: the one named in /command@site or with site:<name> before the search,
+// or the chat's site. It returns the command options without site:<name>.
+// Groups where the bot has privacy mode on only send it commands addressed to the bot, so /command@site doesn't
+// work there, but site:<name> does.
+func siteFor(message *telegramMessage) (booru, string) {
+	options := message.CommandOptions()
+	fields := strings.Fields(options)
+	if len(fields) > 0 && strings.HasPrefix(strings.ToLower(fields[0]), "site:") {
+		if site, ok := bot.sites[strings.ToLower(fields[0][len("site:"):])]; ok {
+			options = strings.TrimSpace(options)
+			return site, strings.TrimSpace(options[len(fields[0]):])
+		}
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Unexpected status code %d from url \"%s\"", resp.StatusCode, location)
+	if site, ok := bot.sites[message.CommandTarget()]; ok {
+		return site, options
 	}
+	return chatSite(message.Chat.ID), options
+}
 
-	if !isJSON(body) {
-		return nil, fmt.Errorf("Body of url \"%s\" is not a JSON", location)
+// parseInlineOffset returns the page that telegram asks for, offset is the next_offset that we gave before
+func parseInlineOffset(offset string) int {
+	page, err := strconv.Atoi(offset)
+	if err != nil || page < 1 {
+		return 1
 	}
+	return page
+}
 
-	// save cache
-	// trace("Saving %s into cache: %d bytes", cacheKey, len(body))
-	err = cache.Set(cacheKey, body)
+// refuseInline answers inline query with no results and a button explaining why
+func refuseInline(ctx context.Context, update telegramUpdate, reason string) error {
+	params := mimeValues{}
+	params.Add("inline_query_id", update.InlineQuery.ID)
+	params.Add("results", "[]")
+	params.Add("cache_time", 1)
+	params.Add("is_personal", "true")
+	button, err := json.Marshal(telegramInlineQueryResultsButton{Text: reason, StartParameter: "settings"})
 	if err != nil {
-		log.Printf("Couldn't set cache data for key \"%s\": %s", cacheKey, err)
-		// don't fail, it's a temporary error and next time it might be fine
+		return err
 	}
-
-	return body, nil
-}
-
-func isJSON(s []byte) bool {
-	var js interface{}
-	return json.Unmarshal(s, &js) == nil
+	params.Add("button", string(button))
+	return bot.sendInternal(ctx, "answerInlineQuery", params, update)
 }
 
-//
 // helper functions
-//
-func replyErrorAndLog(update telegramUpdate, format string, args ...interface{}) {
+func replyErrorAndLog(ctx context.Context, update telegramUpdate, format string, args ...interface{}) {
 	text := fmt.Sprintf(format, args...)
 	err := log.Output(2, text)
 	if err != nil {
@@ -636,37 +1158,126 @@ func replyErrorAndLog(update telegramUpdate, format string, args ...interface{})
 		return
 	}
 	message := fmt.Sprintf("Apologies, got error:\n\n%s\n\nGo pester @hmage to fix this.", text)
-	err = bot.sendMessage(update, message)
+	err = bot.sendMessage(ctx, update, message)
 	if err != nil {
 		// trace("bot.Send() returned %+v", err)
 		return
 	}
 }
 
-//
 // telegram sending
-//
-func (b *telegramBot) sendMessage(update telegramUpdate, message string) error {
+func (b *telegramBot) sendMessage(ctx context.Context, update telegramUpdate, message string) error {
 	params := mimeValues{}
 	err := params.Add("text", message)
 	if err != nil {
 		return err
 	}
 
-	return b.sendInternal("sendMessage", params, update)
+	return b.sendInternal(ctx, "sendMessage", params, update)
 }
 
-func (b *telegramBot) sendChatAction(update telegramUpdate, action string) error {
+// answerCallbackQuery stops the spinner on the button, text is shown to who pressed it if not empty
+func (b *telegramBot) answerCallbackQuery(ctx context.Context, queryID string, text string, alert bool) error {
+	params := mimeValues{}
+	err := params.Add("callback_query_id", queryID)
+	if err != nil {
+		return err
+	}
+	if text != "" {
+		err = params.Add("text", text)
+		if err != nil {
+			return err
+		}
+	}
+	if alert {
+		err = params.Add("show_alert", "true")
+		if err != nil {
+			return err
+		}
+	}
+	return b.sendInternal(ctx, "answerCallbackQuery", params, telegramUpdate{})
+}
+
+// editMessageCaption changes the caption of a message the bot sent, markup can be nil
+func (b *telegramBot) editMessageCaption(ctx context.Context, chatID int64, messageID int64, caption string, markup *telegramInlineKeyboardMarkup) error {
+	params := mimeValues{}
+	err := params.Add("chat_id", chatID)
+	if err != nil {
+		return err
+	}
+	err = params.Add("message_id", messageID)
+	if err != nil {
+		return err
+	}
+	err = params.Add("caption", caption)
+	if err != nil {
+		return err
+	}
+	err = addReplyMarkup(&params, markup)
+	if err != nil {
+		return err
+	}
+	return b.sendInternal(ctx, "editMessageCaption", params, telegramUpdate{})
+}
+
+func (b *telegramBot) deleteMessage(ctx context.Context, chatID int64, messageID int64) error {
+	params := mimeValues{}
+	err := params.Add("chat_id", chatID)
+	if err != nil {
+		return err
+	}
+	err = params.Add("message_id", messageID)
+	if err != nil {
+		return err
+	}
+	return b.sendInternal(ctx, "deleteMessage", params, telegramUpdate{})
+}
+
+func (b *telegramBot) sendChatAction(ctx context.Context, update telegramUpdate, action string) error {
 	params := mimeValues{}
 	err := params.Add("action", action)
 	if err != nil {
 		return err
 	}
 
-	return b.sendInternal("sendChatAction", params, update)
+	return b.sendInternal(ctx, "sendChatAction", params, update)
 }
 
-func (b *telegramBot) sendPhoto(update telegramUpdate, photoURL *url.URL, filename string, caption string) error {
+// getFile downloads a file that someone sent to the bot, telegram only gives bots files up to 20MB
+func (b *telegramBot) getFile(ctx context.Context, fileID string) ([]byte, error) {
+	params := mimeValues{}
+	err := params.Add("file_id", fileID)
+	if err != nil {
+		return nil, err
+	}
+	file := telegramFile{}
+	err = b.sendInternalResult(ctx, "getFile", params, telegramUpdate{}, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get file: %w", err)
+	}
+	if file.FilePath == "" {
+		return nil, fmt.Errorf("Telegram gave no path for file %s", fileID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", b.fileURL(file.FilePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download file %s: %w", fileID, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected status code %d when downloading file %s", resp.StatusCode, fileID)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *telegramBot) sendPhoto(ctx context.Context, update telegramUpdate, photoURL *url.URL, filename string, caption string, spoiler bool, markup *telegramInlineKeyboardMarkup) error {
 	params := mimeValues{}
 	err := params.Add("photo", photoURL.String())
 	if err != nil {
@@ -676,11 +1287,22 @@ func (b *telegramBot) sendPhoto(update telegramUpdate, photoURL *url.URL, filena
 	if err != nil {
 		return fmt.Errorf("Failed to add parameter: %w", err)
 	}
+	if spoiler {
+		err = params.Add("has_spoiler", "true")
+		if err != nil {
+			return fmt.Errorf("Failed to add parameter: %w", err)
+		}
+	}
+
+	err = addReplyMarkup(&params, markup)
+	if err != nil {
+		return err
+	}
 
-	return b.sendInternal("sendPhoto", params, update)
+	return b.sendInternal(ctx, "sendPhoto", params, update)
 }
 
-func (b *telegramBot) sendDocument(update telegramUpdate, documentURL *url.URL, filename string, caption string) error {
+func (b *telegramBot) sendDocument(ctx context.Context, update telegramUpdate, documentURL *url.URL, filename string, caption string, markup *telegramInlineKeyboardMarkup) error {
 	params := mimeValues{}
 	err := params.Add("document", documentURL.String())
 	if err != nil {
@@ -691,10 +1313,104 @@ func (b *telegramBot) sendDocument(update telegramUpdate, documentURL *url.URL,
 		return fmt.Errorf("Failed to add parameter: %w", err)
 	}
 
-	return b.sendInternal("sendDocument", params, update)
+	err = addReplyMarkup(&params, markup)
+	if err != nil {
+		return err
+	}
+
+	return b.sendInternal(ctx, "sendDocument", params, update)
+}
+
+// sendMedia sends media with the method that matches its kind, markup can be nil
+func (b *telegramBot) sendMedia(ctx context.Context, update telegramUpdate, media booruMedia, caption string, markup *telegramInlineKeyboardMarkup) error {
+	switch media.kind {
+	case "animation":
+		return b.sendAnimation(ctx, update, media.url, media.filename, caption, media.spoiler, markup)
+	case "document":
+		return b.sendDocument(ctx, update, media.url, media.filename, caption, markup)
+	case "photo":
+		return b.sendPhoto(ctx, update, media.url, media.filename, caption, media.spoiler, markup)
+	}
+	return fmt.Errorf("Don't know how to send media of kind %q", media.kind)
+}
+
+// addReplyMarkup adds buttons under the message, if there are any
+func addReplyMarkup(params *mimeValues, markup *telegramInlineKeyboardMarkup) error {
+	if markup == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(markup)
+	if err != nil {
+		return err
+	}
+	err = params.Add("reply_markup", string(encoded))
+	if err != nil {
+		return fmt.Errorf("Failed to add parameter: %w", err)
+	}
+	return nil
 }
 
-func (b *telegramBot) sendAnimation(update telegramUpdate, animationURL *url.URL, filename string, caption string) error {
+// sendMediaGroup sends the media as albums with the caption on the first one.
+// Telegram only puts photos and videos together and documents with documents,
+// so gifs go in an album of their own, and an album of one is sent as a single message.
+func (b *telegramBot) sendMediaGroup(ctx context.Context, update telegramUpdate, medias []booruMedia, caption string) error {
+	gallery := []booruMedia{}
+	documents := []booruMedia{}
+	for _, media := range medias {
+		if media.kind == "document" {
+			documents = append(documents, media)
+		} else {
+			gallery = append(gallery, media)
+		}
+	}
+	for _, album := range [][]booruMedia{gallery, documents} {
+		if len(album) == 0 {
+			continue
+		}
+		err := b.sendAlbum(ctx, update, album, caption)
+		if err != nil {
+			return err
+		}
+		caption = ""
+	}
+	return nil
+}
+
+func (b *telegramBot) sendAlbum(ctx context.Context, update telegramUpdate, medias []booruMedia, caption string) error {
+	if len(medias) == 1 {
+		return b.sendMedia(ctx, update, medias[0], caption, nil)
+	}
+	album := []telegramInputMedia{}
+	for i, media := range medias {
+		input := telegramInputMedia{
+			Type:       media.kind,
+			Media:      media.url.String(),
+			Width:      media.width,
+			Height:     media.height,
+			HasSpoiler: media.spoiler,
+		}
+		if media.kind == "animation" {
+			// albums can't have animations, but they are mp4 anyway
+			input.Type = "video"
+		}
+		if i == 0 {
+			input.Caption = caption
+		}
+		album = append(album, input)
+	}
+	encoded, err := json.Marshal(album)
+	if err != nil {
+		return err
+	}
+	params := mimeValues{}
+	err = params.Add("media", string(encoded))
+	if err != nil {
+		return fmt.Errorf("Failed to add parameter: %w", err)
+	}
+	return b.sendInternal(ctx, "sendMediaGroup", params, update)
+}
+
+func (b *telegramBot) sendAnimation(ctx context.Context, update telegramUpdate, animationURL *url.URL, filename string, caption string, spoiler bool, markup *telegramInlineKeyboardMarkup) error {
 	params := mimeValues{}
 	err := params.Add("animation", animationURL.String())
 	if err != nil {
@@ -704,45 +1420,105 @@ func (b *telegramBot) sendAnimation(update telegramUpdate, animationURL *url.URL
 	if err != nil {
 		return fmt.Errorf("Failed to add parameter: %w", err)
 	}
+	if spoiler {
+		err = params.Add("has_spoiler", "true")
+		if err != nil {
+			return fmt.Errorf("Failed to add parameter: %w", err)
+		}
+	}
+
+	err = addReplyMarkup(&params, markup)
+	if err != nil {
+		return err
+	}
+
+	return b.sendInternal(ctx, "sendAnimation", params, update)
+}
 
-	return b.sendInternal("sendAnimation", params, update)
+func (b *telegramBot) sendInternal(ctx context.Context, method string, params mimeValues, update telegramUpdate) error {
+	return b.sendInternalResult(ctx, method, params, update, nil)
 }
 
-func (b *telegramBot) sendInternal(method string, params mimeValues, update telegramUpdate) error {
+// sendInternalResult is like sendInternal, but also decodes the result into result, if it's not nil
+func (b *telegramBot) sendInternalResult(ctx context.Context, method string, params mimeValues, update telegramUpdate, result interface{}) error {
 	// trace("called")
-	if params.writer == nil {
-		return fmt.Errorf("sendInternal() was called with nil mime params writer")
-	}
-	if params.bb == nil {
-		return fmt.Errorf("sendInternal() was called with nil mime params bytes buffer")
+	if len(params.fields) == 0 {
+		return fmt.Errorf("sendInternal() was called with empty mime params")
 	}
 
+	var chatID, replyTo int64
 	if update.Message != nil {
-		err := params.Add("chat_id", update.Message.Chat.ID)
-		if err != nil {
-			return fmt.Errorf("Failed to set chat_id to mime params: %w", err)
+		chatID = b.migratedChatID(update.Message.Chat.ID)
+		replyTo = update.Message.ID
+		if chatID != update.Message.Chat.ID {
+			// message we reply to stayed in the old group
+			replyTo = 0
 		}
+	}
 
-		err = params.Add("reply_to_message_id", update.Message.ID)
+	url := b.methodURL(method)
+	for attempt := 1; ; attempt++ {
+		// chat_id is added on every attempt, it can change if the group was migrated
+		attemptParams := mimeValues{fields: params.fields}
+		if chatID != 0 {
+			err := attemptParams.Add("chat_id", chatID)
+			if err != nil {
+				return fmt.Errorf("Failed to set chat_id to mime params: %w", err)
+			}
+		}
+		if replyTo != 0 {
+			err := attemptParams.Add("reply_to_message_id", replyTo)
+			if err != nil {
+				return fmt.Errorf("Failed to set reply_to_message_id to mime params: %w", err)
+			}
+		}
+
+		err := b.postInternal(ctx, url, attemptParams, result)
+		if err == nil {
+			return nil
+		}
+
+		var tgErr *telegramError
+		if !errors.As(err, &tgErr) {
+			return err
+		}
+		if newChatID := tgErr.parameters.MigrateToChatID; newChatID != 0 && chatID != 0 && newChatID != chatID {
+			log.Printf("Chat %d was migrated to %d, sending %s there", chatID, newChatID, method)
+			err = migrateChat(update.Message.Chat.ID, newChatID)
+			if err != nil {
+				log.Printf("Failed to move chat %d to %d: %s", update.Message.Chat.ID, newChatID, err)
+			}
+			chatID = newChatID
+			replyTo = 0
+			continue
+		}
+		if !tgErr.retryable() || attempt >= maxSendAttempts {
+			return err
+		}
+		delay := retryDelay(attempt, tgErr.parameters.RetryAfter)
+		log.Printf("Telegram %s failed with %s, retrying in %s (attempt %d of %d)", method, err, delay, attempt, maxSendAttempts)
+		err = sleepContext(ctx, delay)
 		if err != nil {
-			return fmt.Errorf("Failed to set reply_to_message_id to mime params: %w", err)
+			return err
 		}
 	}
+}
 
-	err := params.writer.Close()
+// postInternal does a single request to telegram, errors from telegram itself are returned as *telegramError
+func (b *telegramBot) postInternal(ctx context.Context, url string, params mimeValues, result interface{}) error {
+	body, contentType, err := params.encode()
 	if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/%s", b.Token, method)
 	// trace("url is %s", url)
-	req, err := http.NewRequest("POST", url, params.bb)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 
-	contentType := params.writer.FormDataContentType()
 	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", userAgent)
 
 	// trace("contentType is %s", contentType)
 	// trace("req is %s", spew.Sdump(req))
@@ -754,91 +1530,78 @@ func (b *telegramBot) sendInternal(method string, params mimeValues, update tele
 		return err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
-	// trace("response from telegram for method %s: status %s, body %s", method, resp.Status, body)
+	// trace("response from telegram: status %s, body %s", resp.Status, respBody)
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Unexpected status code from Telegram API: %s", resp.Status)
-	}
+	return parseTelegramResponse(resp, respBody, result)
+}
 
-	data := map[string]interface{}{}
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		return err
-	}
-	if data["ok"] != true {
-		return fmt.Errorf("Telegram API returned !ok: %s", data["description"])
-	}
+// empty struct is ready to use
+type mimeValues struct {
+	fields []mimeField
+}
 
-	return nil
+type mimeField struct {
+	key      string
+	value    []byte
+	filename string // only set for files
 }
 
 func (m *mimeValues) Add(key string, value interface{}) error {
-	if m.bb == nil {
-		m.bb = &bytes.Buffer{}
-	}
-	if m.writer == nil {
-		m.writer = multipart.NewWriter(m.bb)
-	}
-	writer, err := m.writer.CreateFormField(key)
-	if err != nil {
-		return err
-	}
-
+	var encoded []byte
 	switch v := value.(type) {
 	case string:
-		_, err = io.Copy(writer, strings.NewReader(v))
-		if err != nil {
-			return err
-		}
+		encoded = []byte(v)
 	case int:
-		_, err = io.Copy(writer, strings.NewReader(strconv.Itoa(v)))
-		if err != nil {
-			return err
-		}
+		encoded = []byte(strconv.Itoa(v))
 	case int64:
-		_, err = io.Copy(writer, strings.NewReader(strconv.FormatInt(v, 10)))
-		if err != nil {
-			return err
-		}
+		encoded = []byte(strconv.FormatInt(v, 10))
 	case []byte:
-		_, err = io.Copy(writer, bytes.NewReader(v))
-		if err != nil {
-			return err
-		}
+		encoded = v
 	default:
 		log.Panicf("Unknown value type %T for key %s", v, key)
 	}
 
-	if x, ok := writer.(io.Closer); ok {
-		defer x.Close()
-	}
+	// copy on append, so that fields shared with another mimeValues are never overwritten
+	m.fields = append(m.fields[:len(m.fields):len(m.fields)], mimeField{key: key, value: encoded})
 	return nil
 }
 
 func (m *mimeValues) AddFile(key string, value []byte, filename string) error {
-	if m.bb == nil {
-		m.bb = &bytes.Buffer{}
-	}
-	if m.writer == nil {
-		m.writer = multipart.NewWriter(m.bb)
-	}
-	writer, err := m.writer.CreateFormFile(key, filename)
-	if err != nil {
-		return err
+	m.fields = append(m.fields[:len(m.fields):len(m.fields)], mimeField{key: key, value: value, filename: filename})
+	return nil
+}
+
+// encode returns multipart body and its content type
+func (m *mimeValues) encode() ([]byte, string, error) {
+	bb := &bytes.Buffer{}
+	writer := multipart.NewWriter(bb)
+	for _, field := range m.fields {
+		var part io.Writer
+		var err error
+		if field.filename != "" {
+			part, err = writer.CreateFormFile(field.key, field.filename)
+		} else {
+			part, err = writer.CreateFormField(field.key)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = part.Write(field.value)
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	_, err = io.Copy(writer, bytes.NewReader(value))
+	err := writer.Close()
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	if x, ok := writer.(io.Closer); ok {
-		defer x.Close()
-	}
-	return nil
+	return bb.Bytes(), writer.FormDataContentType(), nil
 }
+
 func (t *telegramDate) UnmarshalJSON(b []byte) error {
 	var value int64
 	err := json.Unmarshal(b, &value)
@@ -850,6 +1613,11 @@ func (t *telegramDate) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalJSON writes the date back the way telegram sends it, for updates kept in the state
+func (t telegramDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).Unix())
+}
+
 func (t *telegramDate) String() string {
 	return (*time.Time)(t).String()
 }
@@ -1,34 +1,338 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	rate "github.com/beefsack/go-rate"
 )
 
+func TestMain(m *testing.M) {
+	// tests never talk to real telegram or boorus, see newFakeTelegram and newFakeBooru
+	bot.Token = "test-token"
+	bot.store = newMemoryStorage()
+	bot.chats = newChatStore(bot.store)
+	os.Exit(m.Run())
+}
+
+// telegramCall is a recorded call to the fake telegram
+type telegramCall struct {
+	method string
+	params url.Values
+}
+
+// fakeTelegram pretends to be telegram bot API and records every call made to it
+type fakeTelegram struct {
+	mu      sync.Mutex
+	calls   []telegramCall
+	results map[string]string // method to its JSON result, "true" if missing
+}
+
+// newFakeTelegram starts a fake telegram and points the bot to it until the test ends
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	f := &fakeTelegram{results: map[string]string{}}
+	server := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	bot.APIURL = server.URL
+	t.Cleanup(func() {
+		server.Close()
+		bot.APIURL = ""
+	})
+	return f
+}
+
+func (f *fakeTelegram) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/file/bot"+bot.Token+"/") {
+		// files from getFile
+		w.Write([]byte("fake image"))
+		return
+	}
+	prefix := "/bot" + bot.Token + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, `{"ok": false, "error_code": 404, "description": "Not Found"}`, http.StatusNotFound)
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, prefix)
+	err := r.ParseMultipartForm(1 << 20)
+	if err == http.ErrNotMultipart {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		http.Error(w, `{"ok": false, "error_code": 400, "description": "Bad Request"}`, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, telegramCall{method: method, params: r.Form})
+	result, ok := f.results[method]
+	f.mu.Unlock()
+	if !ok {
+		result = "true"
+	}
+	fmt.Fprintf(w, `{"ok": true, "result": %s}`, result)
+}
+
+// called returns calls of the method in the order they were made
+func (f *fakeTelegram) called(method string) []telegramCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := []telegramCall{}
+	for _, call := range f.calls {
+		if call.method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// sent returns calls that sent something to a chat, in the order they were made
+func (f *fakeTelegram) sent() []telegramCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := []telegramCall{}
+	for _, call := range f.calls {
+		if strings.HasPrefix(call.method, "send") && call.method != "sendChatAction" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// fakeBooru serves JSON fixtures from testdata by request path and records the requests
+type fakeBooru struct {
+	baseURL url.URL
+
+	mu       sync.Mutex
+	requests []*url.URL
+}
+
+func newFakeBooru(t *testing.T, fixtures map[string]string) (*fakeBooru, url.URL) {
+	f := &fakeBooru{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.URL)
+		f.mu.Unlock()
+		fixture, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Errorf("Failed to read fixture: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.baseURL = *baseURL
+	// cached responses from other tests would hide the fixtures
+	cache.Purge()
+	return f, *baseURL
+}
+
+// lastQuery returns the query of the last request made to the fake booru
+func (f *fakeBooru) lastQuery() url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return url.Values{}
+	}
+	return f.requests[len(f.requests)-1].Query()
+}
+
+// newTestDerpibooru is derpibooru backed by fixtures
+func newTestDerpibooru(t *testing.T) (*philomena, *fakeBooru) {
+	d, f := newTestPhilomena(t, "derpibooru")
+	d.tagAliases = derpibooruTagAliases
+	return d, f
+}
+
+// newTestPhilomena is a philomena site backed by derpibooru fixtures
+func newTestPhilomena(t *testing.T, name string) (*philomena, *fakeBooru) {
+	f, baseURL := newFakeBooru(t, map[string]string{
+		"/api/v1/json/search/images":  "derpibooru_search.json",
+		"/api/v1/json/filters/system": "derpibooru_filters.json",
+		"/api/v1/json/images/1001":    "derpibooru_image.json",
+		"/api/v1/json/images/1004":    "derpibooru_image_explicit.json",
+		"/api/v1/json/images/1005":    "derpibooru_image_hidden.json",
+		"/api/v1/json/search/reverse": "derpibooru_reverse.json",
+	})
+	return newPhilomena(name, baseURL, "test-key", nil), f
+}
+
+// newTestE621 is e621 backed by fixtures, without its strict rate limit
+func newTestE621(t *testing.T, blockedTags []string) (*e621, *fakeBooru) {
+	e := newE621(blockedTags)
+	e.rl = rate.New(1000, time.Second)
+	f, baseURL := newFakeBooru(t, map[string]string{
+		"/posts.json":        "e621_posts.json",
+		"/posts/2001.json":   "e621_post.json",
+		"/iqdb_queries.json": "e621_iqdb.json",
+	})
+	e.baseURL = baseURL
+	return e, f
+}
+
+// useBackend makes the bot use the backend and its commands until the test ends
+func useBackend(t *testing.T, backend booru) {
+	previous := bot.backend
+	bot.backend = backend
+	for command, handler := range backend.commands() {
+		messageHandlers[command] = handler
+	}
+	t.Cleanup(func() {
+		for command := range backend.commands() {
+			delete(messageHandlers, command)
+		}
+		bot.backend = previous
+	})
+}
+
+// useSites makes the bot use the sites, first one being the backend, until the test ends
+func useSites(t *testing.T, sites ...*philomena) {
+	useBackend(t, sites[0])
+	previous := bot.sites
+	bot.sites = map[string]booru{}
+	for _, site := range sites {
+		bot.sites[site.name] = site
+	}
+	t.Cleanup(func() {
+		bot.sites = previous
+	})
+}
+
+// useTestBackend makes the fake derpibooru or e621 the only site of the bot until the test ends,
+// blocked are the tags that the config blocks on e621
+func useTestBackend(t *testing.T, name string, blocked []string) *fakeBooru {
+	switch name {
+	case "derpibooru":
+		d, f := newTestDerpibooru(t)
+		useSites(t, d)
+		return f
+	case "e621":
+		e, f := newTestE621(t, blocked)
+		useBackend(t, e)
+		previous := bot.sites
+		bot.sites = map[string]booru{"e621": e}
+		t.Cleanup(func() {
+			bot.sites = previous
+		})
+		return f
+	}
+	t.Fatalf("unknown test backend %q", name)
+	return nil
+}
+
+// useMaxRating sets the rating ceiling of the chat until the test ends
+func useMaxRating(t *testing.T, chatID int64, maxRating string) {
+	err := bot.chats.update(chatID, func(settings *chatSettings) {
+		settings.MaxRating = maxRating
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bot.chats.update(chatID, func(settings *chatSettings) {
+			settings.MaxRating = ""
+		})
+	})
+}
+
+// forgetHistory clears images sent to the chat by earlier runs of the test
+func forgetHistory(t *testing.T, chatID int64) {
+	err := bot.store.update(func(data *storedData) {
+		delete(data.History, chatID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// forgetSearches clears searches made in the chat by earlier runs of the test
+func forgetSearches(t *testing.T, chatID int64) {
+	err := bot.store.update(func(data *storedData) {
+		delete(data.Searches, chatID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMessage(chatID int64, text string) telegramUpdate {
+	return telegramUpdate{
+		ID: 1,
+		Message: &telegramMessage{
+			ID:   10,
+			From: &telegramUser{ID: chatID, FirstName: "Tester"},
+			Chat: telegramChat{ID: chatID, Type: "private"},
+			Text: text,
+		},
+	}
+}
+
 func TestDerpibooru(t *testing.T) {
-	entries, err := getImages("", "")
+	d, f := newTestDerpibooru(t)
+	entries, _, err := d.search(context.Background(), booruQuery{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(entries) != 48 {
-		t.Fatalf("expected 50 entries, got %d", len(entries))
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	// best first
+	for i, id := range []int64{1001, 1002, 1003} {
+		if entries[i].postID() != id {
+			t.Errorf("entry %d is %d, expected %d", i, entries[i].postID(), id)
+		}
+	}
+	query := f.lastQuery()
+	if query.Get("key") != "test-key" || query.Get("sf") != "score" || !strings.HasPrefix(query.Get("q"), "safe, created_at.gt:") {
+		t.Errorf("unexpected query for empty search: %v", query)
 	}
 }
 
 func BenchmarkDerpibooru(b *testing.B) {
+	d := newDerpibooru("", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join("testdata", "derpibooru_search.json"))
+	}))
+	defer server.Close()
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	d.baseURL = *baseURL
+	cache.Purge()
+
 	limit := make(chan bool, 8000)
 	wg := sync.WaitGroup{}
 	for i := 0; i < b.N; i++ {
 		limit <- true
 		wg.Add(1)
 		go func() {
-			entries, err := getImages("", "")
+			entries, _, err := d.search(context.Background(), booruQuery{})
 			if err != nil {
-				b.Fatal(err)
-			}
-			if len(entries) != 50 {
-				b.Fatalf("expected 50 entries, got %d", len(entries))
+				b.Error(err)
+			} else if len(entries) != 3 {
+				b.Errorf("expected 3 entries, got %d", len(entries))
 			}
 			<-limit
 			wg.Done()
@@ -37,10 +341,453 @@ func BenchmarkDerpibooru(b *testing.B) {
 	wg.Wait()
 }
 
-func TestMain(m *testing.M) {
-	err := readConfig("settings.yaml")
+func TestDerpibooruPagesAreCachedSeparately(t *testing.T) {
+	d := newDerpibooru("", nil)
+	pages := map[int]string{
+		1: `{"images": [{"id": 1, "score": 5}]}`,
+		2: `{"images": [{"id": 2, "score": 5}]}`,
+	}
+	for page, body := range pages {
+		key := fmt.Sprintf("derpibooru:search:fluttershy, safe page:%d per_page:50", page)
+		err := cache.Set(key, []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cache.Remove(key)
+	}
+	for page := range pages {
+		posts, _, err := d.search(context.Background(), booruQuery{search: "Fluttershy", rating: "safe", page: page, perPage: 50})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(posts) != 1 || posts[0].postID() != int64(page) {
+			t.Fatalf("page %d: expected post %d, got %v", page, page, posts)
+		}
+	}
+}
+
+func TestDerpibooruFilterIsInCacheKey(t *testing.T) {
+	d := newDerpibooru("", nil)
+	filters := map[int]string{
+		0: `{"images": [{"id": 1, "score": 5}]}`,
+		5: `{"images": [{"id": 2, "score": 5}]}`,
+	}
+	cache.Purge()
+	for filterID, body := range filters {
+		key := "derpibooru:search:fluttershy, safe"
+		if filterID != 0 {
+			key += fmt.Sprintf(" filter:%d", filterID)
+		}
+		err := cache.Set(key, []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for filterID, body := range filters {
+		posts, _, err := d.search(context.Background(), booruQuery{search: "fluttershy", rating: "safe", filterID: filterID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(posts) != 1 || !strings.Contains(body, fmt.Sprintf(`"id": %d`, posts[0].postID())) {
+			t.Errorf("filter %d: got %v from the wrong cache entry", filterID, posts)
+		}
+	}
+}
+
+func TestParseInlineOffset(t *testing.T) {
+	tests := map[string]int{"": 1, "2": 2, "-5": 1, "junk": 1, "17": 17}
+	for offset, expected := range tests {
+		if got := parseInlineOffset(offset); got != expected {
+			t.Errorf("parseInlineOffset(%q) = %d, expected %d", offset, got, expected)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		text    string
+		command string
+		options string
+	}{
+		{"", "", ""},
+		{"hello", "", ""},
+		{"/pony", "pony", ""},
+		{"/Pony@DerpibooruBot", "pony", ""},
+		{"/pony celestia, luna", "pony", "celestia, luna"},
+		{"/pony@DerpibooruBot  celestia", "pony", " celestia"},
+		{"/settings rating safe", "settings", "rating safe"},
+	}
+	for _, test := range tests {
+		m := telegramMessage{Text: test.text}
+		if got := m.Command(); got != test.command {
+			t.Errorf("Command() of %q = %q, expected %q", test.text, got, test.command)
+		}
+		if got := m.CommandOptions(); got != test.options {
+			t.Errorf("CommandOptions() of %q = %q, expected %q", test.text, got, test.options)
+		}
+	}
+}
+
+func TestHandleImage(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   string
+		maxRating string
+		text      string
+		method    string
+		param     string
+		value     string
+		caption   string // after the booru URL
+		q         string // q or tags sent to booru, if not empty
+	}{
+		{
+			name: "best derpibooru image", backend: "derpibooru", text: "/pony fluttershy",
+			method: "sendPhoto", param: "photo", value: "https://derpicdn.net/img/2021/5/1/1001/tall.png",
+			caption: "/1001\nBest recent image for your search", q: "fluttershy, safe",
+		},
+		{
+			name: "aliases and boolean search", backend: "derpibooru", text: "/pony fs, (solo || ts)",
+			method: "sendPhoto", param: "photo", value: "https://derpicdn.net/img/2021/5/1/1001/tall.png",
+			q: "fluttershy, safe, (solo || twilight sparkle)",
+		},
+		{
+			name: "rating above the chat ceiling", backend: "derpibooru", maxRating: "safe", text: "/clop fluttershy",
+			method: "sendMessage", param: "text", value: "Sorry, explicit images are not allowed in this chat, it only allows up to safe.",
+		},
+		{
+			name: "rating in search above the chat ceiling", backend: "derpibooru", maxRating: "suggestive", text: "/pony fluttershy || questionable",
+			method: "sendMessage", param: "text", value: "Sorry, questionable images are not allowed in this chat, it only allows up to suggestive.",
+		},
+		{
+			name: "search that doesn't parse", backend: "derpibooru", text: "/pony (fluttershy",
+			method: "sendMessage", param: "text", value: "Sorry, I can't understand your search: opening parenthesis is never closed",
+		},
+		{
+			name: "only sendable e621 post", backend: "e621", text: "/yiff wolf",
+			method: "sendAnimation", param: "animation", value: "https://static1.e621.net/data/480p/20/01/2001.mp4",
+			caption: "/posts/2001\nRandom recent image for your search", q: "wolf -gore",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			booru := useTestBackend(t, test.backend, []string{"gore"})
+			// every test has its own chat, so that images sent by other tests aren't skipped
+			chatID := int64(42 + i)
+			forgetHistory(t, chatID)
+			update := testMessage(chatID, test.text)
+			if test.maxRating != "" {
+				useMaxRating(t, chatID, test.maxRating)
+			}
+
+			handleUpdate(context.Background(), update)
+
+			calls := telegram.called(test.method)
+			if len(calls) != 1 {
+				t.Fatalf("expected one %s, got %v", test.method, telegram.calls)
+			}
+			params := calls[0].params
+			if got := params.Get(test.param); got != test.value {
+				t.Errorf("%s is %q, expected %q", test.param, got, test.value)
+			}
+			// captions link to the booru the bot is using
+			if caption := booru.baseURL.String() + test.caption; test.caption != "" && params.Get("caption") != caption {
+				t.Errorf("caption is %q, expected %q", params.Get("caption"), caption)
+			}
+			if params.Get("chat_id") != strconv.FormatInt(chatID, 10) || params.Get("reply_to_message_id") != "10" {
+				t.Errorf("expected reply to message 10 in chat %d, got %v", chatID, params)
+			}
+			if test.q != "" {
+				query := booru.lastQuery()
+				got := query.Get("q")
+				if test.backend == "e621" {
+					got = query.Get("tags")
+				}
+				if got != test.q {
+					t.Errorf("search sent to booru is %q, expected %q", got, test.q)
+				}
+			}
+		})
+	}
+}
+
+func TestInlineHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		backend    string
+		maxRating  string
+		blocked    []string // blocked_tags of e621 next to gore
+		query      string
+		offset     string
+		results    []string // types of results in order
+		nextOffset string
+		button     string
+		q          string
+	}{
+		{
+			name: "safe by default", backend: "derpibooru", query: "fluttershy",
+			results: []string{"photo", "gif", "photo"}, nextOffset: "2", q: "fluttershy, safe",
+		},
+		{
+			name: "requested rating within the ceiling", backend: "derpibooru", maxRating: "questionable", query: "fluttershy, questionable", offset: "3",
+			results: []string{"photo", "gif", "photo"}, nextOffset: "4", q: "fluttershy, questionable, (questionable || safe || suggestive)",
+		},
+		{
+			name: "requested rating above the ceiling", backend: "derpibooru", maxRating: "safe", query: "fluttershy OR explicit",
+			results: []string{}, button: "Only images up to safe are allowed",
+		},
+		{
+			name: "negated rating is not a request", backend: "derpibooru", maxRating: "safe", query: "fluttershy, -explicit",
+			results: []string{"photo", "gif", "photo"}, nextOffset: "2", q: "-explicit, fluttershy, safe",
+		},
+		{
+			name: "content rating within the ceiling", backend: "derpibooru", maxRating: "questionable", query: "luna, grimdark",
+			results: []string{"photo", "gif", "photo"}, nextOffset: "2", q: "grimdark, princess luna, (questionable || safe || suggestive)",
+		},
+		{
+			name: "search that doesn't parse", backend: "derpibooru", query: "fluttershy ||",
+			results: []string{}, button: "Can't understand the search: search ends where a tag was expected",
+		},
+		{
+			name: "e621", backend: "e621", query: "wolf rating:safe",
+			results: []string{"mpeg4_gif"}, nextOffset: "2", q: "rating:s wolf -gore",
+		},
+		{
+			name: "page filtered out completely", backend: "e621", blocked: []string{"running"}, query: "wolf rating:safe",
+			results: []string{}, nextOffset: "2", q: "rating:s wolf -gore -running",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			booru := useTestBackend(t, test.backend, append([]string{"gore"}, test.blocked...))
+			if test.maxRating != "" {
+				useMaxRating(t, 42, test.maxRating)
+			}
+			update := telegramUpdate{
+				ID: 1,
+				InlineQuery: &telegramInlineQuery{
+					ID:     "inline-1",
+					From:   &telegramUser{ID: 42},
+					Query:  test.query,
+					Offset: test.offset,
+				},
+			}
+
+			handleUpdate(context.Background(), update)
+
+			calls := telegram.called("answerInlineQuery")
+			if len(calls) != 1 {
+				t.Fatalf("expected one answerInlineQuery, got %v", telegram.calls)
+			}
+			params := calls[0].params
+			if params.Get("inline_query_id") != "inline-1" {
+				t.Errorf("answered wrong inline query: %v", params)
+			}
+			results := []telegramInlineQueryResult{}
+			err := json.Unmarshal([]byte(params.Get("results")), &results)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types := []string{}
+			for _, result := range results {
+				types = append(types, result.Type)
+			}
+			if strings.Join(types, " ") != strings.Join(test.results, " ") {
+				t.Errorf("results are %v, expected %v", types, test.results)
+			}
+			if params.Get("next_offset") != test.nextOffset {
+				t.Errorf("next_offset is %q, expected %q", params.Get("next_offset"), test.nextOffset)
+			}
+			if test.button != "" {
+				button := telegramInlineQueryResultsButton{}
+				err := json.Unmarshal([]byte(params.Get("button")), &button)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if button.Text != test.button {
+					t.Errorf("button says %q, expected %q", button.Text, test.button)
+				}
+			}
+			if test.q != "" {
+				query := booru.lastQuery()
+				got := query.Get("q")
+				if test.backend == "e621" {
+					got = query.Get("tags")
+				}
+				if got != test.q {
+					t.Errorf("search sent to booru is %q, expected %q", got, test.q)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBaseURL(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string // empty means error
+	}{
+		{"https://ponybooru.org", "https://ponybooru.org"},
+		{"https://ponybooru.org/", "https://ponybooru.org"},
+		{"http://localhost:8081", "http://localhost:8081"},
+		{"ponybooru.org", ""},
+		{"ftp://ponybooru.org", ""},
+		{"https://ponybooru.org/?key=1", ""},
+	}
+	for _, test := range tests {
+		u, err := parseBaseURL(test.s)
+		switch {
+		case test.expected == "" && err == nil:
+			t.Errorf("parseBaseURL(%q) = %s, expected an error", test.s, u)
+		case test.expected != "" && err != nil:
+			t.Errorf("parseBaseURL(%q) failed: %s", test.s, err)
+		case test.expected != "" && u.String() != test.expected:
+			t.Errorf("parseBaseURL(%q) = %s, expected %s", test.s, u, test.expected)
+		}
+	}
+
+	d := newDerpibooru("", nil)
+	if got := d.postURL(1); got != "https://derpibooru.org/1" {
+		t.Errorf("default derpibooru post URL is %s", got)
+	}
+	mirror, err := parseBaseURL("https://ponybooru.org")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	d.baseURL = *mirror
+	if got := d.postURL(1); got != "https://ponybooru.org/1" {
+		t.Errorf("mirror post URL is %s, expected https://ponybooru.org/1", got)
+	}
+}
+
+func TestSiteRouting(t *testing.T) {
+	telegram := newFakeTelegram(t)
+	derpibooru, derpibooruServer := newTestPhilomena(t, "derpibooru")
+	ponybooru, ponybooruServer := newTestPhilomena(t, "ponybooru")
+	ponybooru.filterID = 2
+	useSites(t, derpibooru, ponybooru)
+
+	tests := []struct {
+		text   string
+		site   string // set with /site before the command
+		server *fakeBooru
+	}{
+		{"/pony fluttershy", "", derpibooruServer},
+		{"/pony@ponybooru fluttershy", "", ponybooruServer},
+		{"/pony@PonyBooru fluttershy", "", ponybooruServer},
+		{"/pony@DerpibooruBot fluttershy", "", derpibooruServer},
+		{"/pony fluttershy", "ponybooru", ponybooruServer},
+		{"/pony@derpibooru fluttershy", "ponybooru", derpibooruServer},
+		{"/pony site:ponybooru fluttershy", "", ponybooruServer},
+		{"/pony@DerpibooruBot Site:PonyBooru fluttershy", "", ponybooruServer},
+		{"/pony site:derpibooru fluttershy", "ponybooru", derpibooruServer},
+	}
+	for i, test := range tests {
+		chatID := int64(100 + i)
+		forgetHistory(t, chatID)
+		if test.site != "" {
+			handleUpdate(context.Background(), testMessage(chatID, "/site "+test.site))
+		}
+		cache.Purge()
+		handleUpdate(context.Background(), testMessage(chatID, test.text))
+
+		calls := telegram.called("sendPhoto")
+		if len(calls) != i+1 {
+			t.Fatalf("%q: expected a photo, got %v", test.text, telegram.calls)
+		}
+		caption := calls[i].params.Get("caption")
+		if !strings.HasPrefix(caption, test.server.baseURL.String()+"/1001\n") {
+			t.Errorf("%q: caption %q links to the wrong site", test.text, caption)
+		}
+		if q := test.server.lastQuery().Get("q"); !strings.Contains(q, "fluttershy") || strings.Contains(q, "site:") {
+			t.Errorf("%q: site went into the search %q", test.text, q)
+		}
+	}
+
+	if got := ponybooruServer.lastQuery().Get("filter_id"); got != "2" {
+		t.Errorf("ponybooru got filter_id %q, expected 2", got)
+	}
+	if got := derpibooruServer.lastQuery().Get("filter_id"); got != "" {
+		t.Errorf("derpibooru got filter_id %q, expected none", got)
+	}
+}
+
+func TestHandlePost(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   string
+		maxRating string
+		text      string // {booru} is replaced with the fake booru URL
+		method    string
+		param     string
+		value     string
+	}{
+		{
+			name: "post number", backend: "derpibooru", text: "/pony 1001",
+			method: "sendPhoto", param: "caption", value: "{booru}/1001\nImage you asked for",
+		},
+		{
+			name: "pasted link", backend: "derpibooru", text: "/pony {booru}/images/1001?q=fluttershy",
+			method: "sendPhoto", param: "photo", value: "https://derpicdn.net/img/2021/5/1/1001/tall.png",
+		},
+		{
+			name: "short link", backend: "derpibooru", text: "/randpony {booru}/1001",
+			method: "sendPhoto", param: "photo", value: "https://derpicdn.net/img/2021/5/1/1001/tall.png",
+		},
+		{
+			name: "rating of the command", backend: "derpibooru", text: "/clop 1001",
+			method: "sendMessage", param: "text", value: "Sorry, post 1001 is safe, and /clop only sends explicit images.",
+		},
+		{
+			name: "rating above the chat ceiling", backend: "derpibooru", maxRating: "questionable", text: "/pony 1004",
+			method: "sendMessage", param: "text", value: "Sorry, explicit images are not allowed in this chat, it only allows up to questionable.",
+		},
+		{
+			name: "missing post", backend: "derpibooru", text: "/pony 999",
+			method: "sendMessage", param: "text", value: "Sorry, there's no post 999 on derpibooru that I could send.",
+		},
+		{
+			name: "hidden post", backend: "derpibooru", text: "/pony 1005",
+			method: "sendMessage", param: "text", value: "Sorry, there's no post 1005 on derpibooru that I could send.",
+		},
+		{
+			name: "e621 link", backend: "e621", text: "/yiff {booru}/posts/2001",
+			method: "sendAnimation", param: "animation", value: "https://static1.e621.net/data/480p/20/01/2001.mp4",
+		},
+		{
+			name: "limiter of the command", backend: "e621", text: "/feral 2001",
+			method: "sendMessage", param: "text", value: "Sorry, post 2001 isn't tagged feral.",
+		},
+		{
+			name: "blocked tag", backend: "e621", text: "/block wolf",
+			method: "sendMessage", param: "text", value: "Sorry, post 2001 has tags that are blocked in this chat.",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			booru := useTestBackend(t, test.backend, nil)
+			chatID := int64(300 + i)
+			if test.maxRating != "" {
+				useMaxRating(t, chatID, test.maxRating)
+			}
+			text := strings.ReplaceAll(test.text, "{booru}", booru.baseURL.String())
+			if strings.HasPrefix(text, "/block ") {
+				handleUpdate(context.Background(), testMessage(chatID, text))
+				text = "/yiff 2001"
+			}
+
+			handleUpdate(context.Background(), testMessage(chatID, text))
+
+			calls := telegram.called(test.method)
+			if len(calls) == 0 {
+				t.Fatalf("expected %s, got %v", test.method, telegram.calls)
+			}
+			expected := strings.ReplaceAll(test.value, "{booru}", booru.baseURL.String())
+			if got := calls[len(calls)-1].params.Get(test.param); got != expected {
+				t.Errorf("%s is %q, expected %q", test.param, got, expected)
+			}
+		})
 	}
-	os.Exit(m.Run())
 }
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	rate "github.com/beefsack/go-rate"
+)
+
+type e621Entry struct {
+	// fields we're not interested in are not here
+	ID int64
+
+	Score struct {
+		Up    int
+		Down  int
+		Total int
+	}
+	File struct {
+		Ext    string
+		Width  int
+		Height int
+		Url    string `json:"url"`
+		Size   int64
+	}
+	Sample struct {
+		Has    bool
+		Width  int
+		Height int
+		Url    string
+		// videos have mp4 and webm versions of different sizes, keyed by size like "480p"
+		Alternates map[string]json.RawMessage
+	}
+	Preview struct {
+		Width  int
+		Height int
+		Url    string
+	}
+	Rating  string              // "s", "q" or "e"
+	Tags    map[string][]string // tags by their group, e.g. "general", "species" or "artist"
+	Sources []string
+}
+
+type e621 struct {
+	baseURL     url.URL // where the API is, tests point it to a fake server
+	blockedTags []string
+	rl          *rate.RateLimiter
+}
+
+const (
+	e621Hello   = "Hello! I'm a bot that sends you images from %s.\n\nTo get a random top scoring picture: /yiff\n\nTo search for horsecock: /yiff horsecock\n\nYou get the idea :)"
+	e621MaxRPS  = 1  // requests per second
+	e621MaxTags = 40 // e621 refuses searches with more tags than that
+
+	telegramMaxPhotoSize = 5 * 1024 * 1024 // telegram won't take photos bigger than that by URL
+)
+
+// e621Alternate is a video version of the post
+type e621Alternate struct {
+	Type   string
+	Width  int
+	Height int
+	Urls   []string
+}
+
+// preferred sizes of video alternates, first one that the post has wins
+var e621AlternateSizes = []string{"480p", "720p", "original"}
+
+func newE621(blockedTags []string) *e621 {
+	return &e621{
+		baseURL:     url.URL{Scheme: "https", Host: "e621.net"},
+		blockedTags: blockedTags,
+		rl:          rate.New(e621MaxRPS, time.Second),
+	}
+}
+
+func (e *e621) hello() string {
+	return fmt.Sprintf(e621Hello, e.baseURL.Host)
+}
+
+func (e *e621) commands() map[string]func(context.Context, telegramUpdate) error {
+	return map[string]func(context.Context, telegramUpdate) error{
+		"yiff":      handleYiff,
+		"feral":     handleFeral,
+		"horsecock": handleHorsecock,
+	}
+}
+
+func (e *e621) postURL(id int64) string {
+	return fmt.Sprintf("%s/posts/%d", e.baseURL.String(), id)
+}
+
+// splitTags splits space-separated tags, e621 uses underscores instead of spaces in tags
+func (e *e621) splitTags(s string) []string {
+	tags := []string{}
+	for _, tag := range strings.Fields(s) {
+		tags = append(tags, strings.ToLower(tag))
+	}
+	return tags
+}
+
+// e621TagAliases are long forms of metatags that e621 also accepts in short form
+var e621TagAliases = map[string]string{
+	"rating:safe":         "rating:s",
+	"rating:questionable": "rating:q",
+	"rating:explicit":     "rating:e",
+}
+
+func (e *e621) parseQuery(search string) (*queryNode, error) {
+	node, err := parseE621Query(search)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeQuery(node, e621TagAliases), nil
+}
+
+func (e *e621) search(ctx context.Context, query booruQuery) ([]booruPost, bool, error) {
+	url := e.baseURL
+	url.Path = "/posts.json"
+	params := url.Query()
+
+	search, err := e.parseQuery(query.search)
+	if err != nil {
+		return nil, false, err
+	}
+	q := []*queryNode{search}
+	if query.limiter != "" {
+		q = append(q, tagQuery(strings.ToLower(query.limiter)))
+	}
+	switch {
+	case query.rating != "":
+		q = append(q, tagQuery(e621Rating(query.rating)))
+	case query.maxRating != "":
+		q = append(q, e621MaxRating(query.maxRating))
+	}
+
+	tags, err := formatE621Query(normalizeQuery(andQuery(q...), e621TagAliases))
+	if err != nil {
+		return nil, false, err
+	}
+	// cache key must only use user input, so ignore rest
+	// chat's blocked tags change the results though, so they go into the cache key
+	cacheKey := "e621:search:" + strings.Join(tags, " ")
+	for _, tag := range query.blockedTags {
+		cacheKey += " -" + strings.ToLower(tag)
+	}
+	cacheKey += query.pageKey()
+
+	// synthesize more query parameters based on settings
+
+	// if search is empty, we need top scoring ones in last 3 days
+	if search == nil {
+		// it's an empty search, so choose best in last 3 days
+		from := time.Now().Add(time.Hour * 24 * 3 * -1)
+		tags = append(tags, "order:score", "date:>="+from.Format("2006-01-02"))
+	}
+
+	// enforce blocked tags, e621 limits how many tags a search can have,
+	// so the ones that don't fit are only filtered out after fetching
+	blocked := e.allBlockedTags(query)
+	for _, tag := range blocked {
+		if len(tags) >= e621MaxTags {
+			break
+		}
+		if containsString(tags, "-"+tag) {
+			continue
+		}
+		tags = append(tags, "-"+tag)
+	}
+
+	// we have our search query, set it and encode into URL
+	params.Set("tags", strings.Join(tags, " "))
+	params.Set("limit", "100")
+	if query.perPage > 0 {
+		params.Set("limit", strconv.Itoa(query.perPage))
+	}
+	if query.page > 1 {
+		params.Set("page", strconv.Itoa(query.page))
+	}
+	url.RawQuery = params.Encode()
+	location := url.String()
+
+	// fetch the URL, cache to avoid re-fetching if possible
+	jsonBody, err := cachedGet(ctx, location, cacheKey, e.rl)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to get from URL %s: %w", location, err)
+	}
+
+	// parse json body
+	root := map[string]*json.RawMessage{}
+	err = json.Unmarshal(jsonBody, &root)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// now get actual images json
+	parent := "posts"
+	if root[parent] == nil {
+		return nil, false, fmt.Errorf("Response from URL %s has no %q in it", location, parent)
+	}
+	entries := []e621Entry{}
+	err = json.Unmarshal(*root[parent], &entries)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// a page can be filtered out completely, next pages can still have posts
+	more := len(entries) > 0
+
+	// filter out problematic entries
+	newentries := []e621Entry{}
+	for _, entry := range entries {
+		if !entry.sendable() {
+			continue
+		}
+		if entry.hasAnyTag(blocked) {
+			continue
+		}
+		newentries = append(newentries, entry)
+	}
+	entries = newentries
+
+	// sort by score
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Score.Total > entries[j].Score.Total })
+
+	posts := make([]booruPost, len(entries))
+	for i := range entries {
+		posts[i] = entries[i]
+	}
+	return posts, more, nil
+}
+
+// e621Rating maps our rating to e621's, e621 has no suggestive so it's treated as safe
+func e621Rating(rating string) string {
+	switch rating {
+	case "questionable":
+		return "rating:q"
+	case "explicit":
+		return "rating:e"
+	}
+	return "rating:s"
+}
+
+// e621MaxRating matches any rating up to maxRating, nil means anything goes
+func e621MaxRating(maxRating string) *queryNode {
+	switch maxRating {
+	case "explicit":
+		return nil
+	case "questionable":
+		return notQuery(tagQuery("rating:e"))
+	}
+	return tagQuery("rating:s")
+}
+
+func (e *e621) getImage(ctx context.Context, id int64) (booruPost, error) {
+	url := e.baseURL
+	url.Path = fmt.Sprintf("/posts/%d.json", id)
+	location := url.String()
+
+	cacheKey := fmt.Sprintf("e621:post:%d", id)
+	jsonBody, err := cachedGet(ctx, location, cacheKey, e.rl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get from URL %s: %w", location, err)
+	}
+
+	root := map[string]*json.RawMessage{}
+	err = json.Unmarshal(jsonBody, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := "post"
+	if root[parent] == nil {
+		return nil, fmt.Errorf("Response from URL %s has no %q in it", location, parent)
+	}
+	entry := e621Entry{}
+	err = json.Unmarshal(*root[parent], &entry)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.sendable() {
+		// deleted posts have no file
+		return nil, fmt.Errorf("Post %d can't be sent to telegram: %w", id, errPostNotFound)
+	}
+	return entry, nil
+}
+
+// e621IqdbMatch is a post found by iqdb, e621's reverse image search
+type e621IqdbMatch struct {
+	// fields we're not interested in are not here
+	PostID int64   `json:"post_id"`
+	Score  float64 `json:"score"` // similarity in percent
+}
+
+// reverseSearch uploads the image to iqdb, posts come without details and are fetched separately when needed
+func (e *e621) reverseSearch(ctx context.Context, image []byte, filename string) ([]booruMatch, error) {
+	url := e.baseURL
+	url.Path = "/iqdb_queries.json"
+	location := url.String()
+
+	params := mimeValues{}
+	err := params.AddFile("file", image, filename)
+	if err != nil {
+		return nil, err
+	}
+	jsonBody, err := postMultipart(ctx, location, params, e.rl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to post to URL %s: %w", location, err)
+	}
+
+	// when nothing is found, iqdb answers with an object instead of a list
+	if !strings.HasPrefix(strings.TrimSpace(string(jsonBody)), "[") {
+		return nil, nil
+	}
+	found := []e621IqdbMatch{}
+	err = json.Unmarshal(jsonBody, &found)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Score > found[j].Score })
+
+	matches := []booruMatch{}
+	for _, match := range found {
+		matches = append(matches, booruMatch{id: match.PostID, distance: 100 - match.Score})
+	}
+	return matches, nil
+}
+
+// postIDFromURL recognizes https://e621.net/posts/123 and old https://e621.net/post/show/123
+func (e *e621) postIDFromURL(u *url.URL) (int64, bool) {
+	if !sameHost(u, e.baseURL) {
+		return 0, false
+	}
+	for _, prefix := range []string{"/posts/", "/post/show/"} {
+		if strings.HasPrefix(u.Path, prefix) {
+			return parsePostID(strings.TrimPrefix(u.Path, prefix))
+		}
+	}
+	return 0, false
+}
+
+// allBlockedTags merges blocked tags from the config with the ones blocked in the chat
+func (e *e621) allBlockedTags(query booruQuery) []string {
+	blocked := []string{}
+	for _, tag := range append(append([]string{}, query.blockedTags...), e.blockedTags...) {
+		tag = strings.ToLower(tag)
+		if !containsString(blocked, tag) {
+			blocked = append(blocked, tag)
+		}
+	}
+	return blocked
+}
+
+// hasAnyTag reports whether the post has any of the tags in any of its tag groups
+func (e e621Entry) hasAnyTag(tags []string) bool {
+	for _, group := range e.Tags {
+		for _, tag := range group {
+			if containsString(tags, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mp4Alternate finds mp4 version of a video post, webm can't be sent to telegram
+func (e e621Entry) mp4Alternate() (location string, width int, height int) {
+	for _, size := range e621AlternateSizes {
+		raw, ok := e.Sample.Alternates[size]
+		if !ok {
+			continue
+		}
+		alternate := e621Alternate{}
+		err := json.Unmarshal(raw, &alternate)
+		if err != nil {
+			continue
+		}
+		for _, u := range alternate.Urls {
+			if strings.HasSuffix(u, ".mp4") {
+				return u, alternate.Width, alternate.Height
+			}
+		}
+	}
+	return "", 0, 0
+}
+
+// sendable reports whether telegram can show the post at all
+func (e e621Entry) sendable() bool {
+	// remove webm without mp4 version, and swf
+	if e.File.Ext == "webm" {
+		location, _, _ := e.mp4Alternate()
+		return location != ""
+	}
+	if e.File.Ext == "swf" {
+		return false
+	}
+	// remove entries with null urls
+	if e.File.Url == "" {
+		return false
+	}
+	return true
+}
+
+func (e e621Entry) postID() int64 {
+	return e.ID
+}
+
+func (e e621Entry) postScore() int64 {
+	return int64(e.Score.Total)
+}
+
+func (e e621Entry) postRating() string {
+	switch e.Rating {
+	case "s":
+		return "safe"
+	case "q":
+		return "questionable"
+	case "e":
+		return "explicit"
+	}
+	return ""
+}
+
+func (e e621Entry) postTags() []string {
+	tags := []string{}
+	for _, group := range e.Tags {
+		tags = append(tags, group...)
+	}
+	return tags
+}
+
+func (e e621Entry) postArtists() []string {
+	return e.Tags["artist"]
+}
+
+func (e e621Entry) postSources() []string {
+	return e.Sources
+}
+
+func (e e621Entry) media() (booruMedia, error) {
+	media := booruMedia{
+		kind:     "photo",
+		width:    e.File.Width,
+		height:   e.File.Height,
+		filename: fmt.Sprintf("%d.%s", e.ID, e.File.Ext),
+	}
+
+	location := e.File.Url
+	// telegram API limits to 5 megabytes for photos (gif isn't a photo)
+	if e.File.Ext == "webm" {
+		media.kind = "animation"
+		location, media.width, media.height = e.mp4Alternate()
+		media.filename = fmt.Sprintf("%d.mp4", e.ID)
+	} else if e.File.Ext == "gif" {
+		media.kind = "document"
+	} else if e.File.Size > telegramMaxPhotoSize {
+		if e.Sample.Has { // have sample? use it
+			location = e.Sample.Url
+			media.width, media.height = e.Sample.Width, e.Sample.Height
+		} else {
+			location = e.Preview.Url // don't have sample, use tiny preview
+			media.width, media.height = e.Preview.Width, e.Preview.Height
+		}
+	}
+
+	var err error
+	media.url, err = parseMediaURL(location)
+	if err != nil {
+		return booruMedia{}, err
+	}
+	return media, nil
+}
+
+func (e *e621) inlineMedia(post booruPost) (booruMedia, error) {
+	entry, ok := post.(e621Entry)
+	if !ok {
+		return booruMedia{}, fmt.Errorf("Got %T instead of e621 entry", post)
+	}
+	thumbURL, err := parseMediaURL(entry.Preview.Url)
+	if err != nil {
+		return booruMedia{}, fmt.Errorf("Failed parsing thumb URL: %w", err)
+	}
+	media := booruMedia{
+		kind:     "photo",
+		thumbURL: thumbURL,
+		width:    entry.File.Width,
+		height:   entry.File.Height,
+	}
+
+	location := entry.File.Url
+	switch {
+	case entry.File.Ext == "webm":
+		media.kind = "animation"
+		location, media.width, media.height = entry.mp4Alternate()
+	case entry.File.Size <= telegramMaxPhotoSize && entry.File.Ext == "gif":
+		media.kind = "animation"
+	case entry.File.Size <= telegramMaxPhotoSize:
+		// original is small enough
+	case entry.Sample.Has:
+		// samples are always jpeg, even for gifs
+		location = entry.Sample.Url
+		media.width, media.height = entry.Sample.Width, entry.Sample.Height
+	default:
+		location = entry.Preview.Url
+		media.width, media.height = entry.Preview.Width, entry.Preview.Height
+	}
+
+	media.url, err = parseMediaURL(location)
+	if err != nil {
+		return booruMedia{}, fmt.Errorf("Failed parsing photo URL: %w", err)
+	}
+	return media, nil
+}
+
+// --------------------
+// e621 command handlers
+// --------------------
+func handleYiff(ctx context.Context, update telegramUpdate) error {
+	return handleImage(ctx, update, "", "", true)
+}
+
+func handleFeral(ctx context.Context, update telegramUpdate) error {
+	return handleImage(ctx, update, "", "feral", true)
+}
+
+func handleHorsecock(ctx context.Context, update telegramUpdate) error {
+	return handleImage(ctx, update, "", "horsecock", true)
+}
@@ -1,9 +1,9 @@
 #!/usr/bin/env bash
 
 OURDIR="${BASH_SOURCE%/*}"
-cd "$OURDIR"/e621
+cd "$OURDIR"
 while true; do
-    go build && ./e621
+    go build && ./derpibooru_bot e621.yaml
     echo ============== restart ==============
     sleep 1
 done
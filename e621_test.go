@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestE621(t *testing.T) {
+	e, f := newTestE621(t, []string{"gore"})
+	entries, _, err := e.search(context.Background(), booruQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// swf, post with blocked tag and post without file are filtered out
+	if len(entries) != 1 || entries[0].postID() != 2001 {
+		t.Fatalf("expected only post 2001, got %v", entries)
+	}
+	if tags := f.lastQuery().Get("tags"); !strings.HasPrefix(tags, "order:score date:>=") || !strings.HasSuffix(tags, " -gore") {
+		t.Errorf("unexpected tags for empty search: %q", tags)
+	}
+}
+
+func TestE621BlockedTagsFilteredAfterFetching(t *testing.T) {
+	body := `{"posts": [
+		{"id": 1, "score": {"total": 10}, "file": {"ext": "png", "url": "https://static1.e621.net/1.png"}, "tags": {"general": ["solo"], "species": ["canine"]}},
+		{"id": 2, "score": {"total": 20}, "file": {"ext": "png", "url": "https://static1.e621.net/2.png"}, "tags": {"general": ["gore"], "species": ["feline"]}},
+		{"id": 3, "score": {"total": 30}, "file": {"ext": "webm", "url": "https://static1.e621.net/3.webm"}, "tags": {"general": ["solo"]}}
+	]}`
+	err := cache.Set("e621:search:canine -feline", []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Remove("e621:search:canine -feline")
+
+	posts, _, err := newE621([]string{"gore"}).search(context.Background(), booruQuery{search: "canine", blockedTags: []string{"feline"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].postID() != 1 {
+		t.Fatalf("expected only post 1 to be left, got %v", posts)
+	}
+
+	// chats can block more tags than e621 allows in a search, the rest are filtered out after fetching
+	e, f := newTestE621(t, []string{"gore"})
+	blocked := []string{}
+	for i := 0; i < 59; i++ {
+		blocked = append(blocked, fmt.Sprintf("blocked%d", i))
+	}
+	blocked = append(blocked, "canine")
+	posts, _, err = e.search(context.Background(), booruQuery{search: "solo", blockedTags: blocked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := strings.Fields(f.lastQuery().Get("tags"))
+	if len(tags) > e621MaxTags || containsString(tags, "-canine") {
+		t.Errorf("expected at most %d tags without -canine, got %d: %v", e621MaxTags, len(tags), tags)
+	}
+	if len(posts) != 0 {
+		t.Errorf("expected post 2001 tagged canine to be filtered out, got %v", posts)
+	}
+}
+
+func TestE621InlineMedia(t *testing.T) {
+	body := `[
+		{"id": 1, "file": {"ext": "png", "size": 1000, "url": "https://static1.e621.net/1.png"}, "preview": {"url": "https://static1.e621.net/preview/1.jpg"}},
+		{"id": 2, "file": {"ext": "png", "size": 9000000, "url": "https://static1.e621.net/2.png"}, "sample": {"has": true, "url": "https://static1.e621.net/sample/2.jpg"}, "preview": {"url": "https://static1.e621.net/preview/2.jpg"}},
+		{"id": 3, "file": {"ext": "gif", "size": 1000, "url": "https://static1.e621.net/3.gif"}, "preview": {"url": "https://static1.e621.net/preview/3.jpg"}},
+		{"id": 4, "file": {"ext": "gif", "size": 9000000, "url": "https://static1.e621.net/4.gif"}, "preview": {"url": "https://static1.e621.net/preview/4.jpg"}},
+		{"id": 5, "file": {"ext": "webm", "size": 9000000, "url": "https://static1.e621.net/5.webm"}, "sample": {"has": true, "url": "https://static1.e621.net/sample/5.jpg", "alternates": {"480p": {"type": "video", "width": 640, "height": 480, "urls": ["https://static1.e621.net/480p/5.webm", "https://static1.e621.net/480p/5.mp4"]}}}, "preview": {"url": "https://static1.e621.net/preview/5.jpg"}}
+	]`
+	entries := []e621Entry{}
+	err := json.Unmarshal([]byte(body), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		kind string
+		url  string
+	}{
+		{"photo", "https://static1.e621.net/1.png"},
+		{"photo", "https://static1.e621.net/sample/2.jpg"},
+		{"animation", "https://static1.e621.net/3.gif"},
+		{"photo", "https://static1.e621.net/preview/4.jpg"},
+		{"animation", "https://static1.e621.net/480p/5.mp4"},
+	}
+	backend := newE621(nil)
+	for i, entry := range entries {
+		if !entry.sendable() {
+			t.Errorf("post %d: expected to be sendable", entry.ID)
+			continue
+		}
+		media, err := backend.inlineMedia(entry)
+		if err != nil {
+			t.Errorf("post %d: %s", entry.ID, err)
+			continue
+		}
+		if media.kind != expected[i].kind || media.url.String() != expected[i].url {
+			t.Errorf("post %d: expected %s %s, got %s %s", entry.ID, expected[i].kind, expected[i].url, media.kind, media.url)
+		}
+		if media.thumbURL.String() != entry.Preview.Url {
+			t.Errorf("post %d: expected thumb %s, got %s", entry.ID, entry.Preview.Url, media.thumbURL)
+		}
+	}
+}
+
+func TestRateLimitWaitStopsOnShutdown(t *testing.T) {
+	// e621 allows a request a second, shutdown must not wait for the next one
+	rl := newE621(nil).rl
+	ctx, cancel := context.WithCancel(context.Background())
+	err := waitRate(ctx, rl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	start := time.Now()
+	if err := waitRate(ctx, rl); err == nil {
+		t.Errorf("expected waiting to be cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("cancelled wait took %s", elapsed)
+	}
+}
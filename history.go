@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	maxHistoryPages = 3 // pages of results searched for images that weren't sent recently
+)
+
+func (b *telegramBot) historySize() int {
+	if b.HistorySize <= 0 {
+		return defaultHistorySize
+	}
+	return b.HistorySize
+}
+
+func (b *telegramBot) historyTTL() time.Duration {
+	if b.HistoryTTL <= 0 {
+		return defaultHistoryTTL * time.Second
+	}
+	return time.Duration(b.HistoryTTL) * time.Second
+}
+
+// recentlySent returns images sent to the chat within history_ttl, only with their site and ID
+func recentlySent(chatID int64) map[sentImage]bool {
+	recent := map[sentImage]bool{}
+	if bot.store == nil {
+		return recent
+	}
+	since := time.Now().Add(-bot.historyTTL())
+	bot.store.view(func(data *storedData) {
+		for _, image := range data.History[chatID] {
+			if image.SentAt.After(since) {
+				recent[sentImage{Site: image.Site, ID: image.ID}] = true
+			}
+		}
+	})
+	return recent
+}
+
+// rememberSent adds the image to the chat's history, keeping only the last history_size images
+func rememberSent(chatID int64, site string, id int64) {
+	if bot.store == nil {
+		return
+	}
+	err := bot.store.update(func(data *storedData) {
+		history := append(data.History[chatID], sentImage{Site: site, ID: id, SentAt: time.Now()})
+		if size := bot.historySize(); len(history) > size {
+			history = append([]sentImage(nil), history[len(history)-size:]...)
+		}
+		data.History[chatID] = history
+		forgetExpired(data, time.Now())
+	})
+	if err != nil {
+		// the image was sent anyway, at worst it'll be repeated
+		log.Printf("Failed to remember image %d sent to chat %d: %s", id, chatID, err)
+	}
+}
+
+// forgetExpired drops images sent longer than history_ttl ago and searches older than searchTTL from every chat,
+// so that chats that went quiet don't stay in the data file forever. It runs whenever an image is sent.
+func forgetExpired(data *storedData, now time.Time) {
+	since := now.Add(-bot.historyTTL())
+	for chatID, history := range data.History {
+		kept := []sentImage{}
+		for _, image := range history {
+			if image.SentAt.After(since) {
+				kept = append(kept, image)
+			}
+		}
+		switch {
+		case len(kept) == 0:
+			delete(data.History, chatID)
+		case len(kept) < len(history):
+			data.History[chatID] = kept
+		}
+	}
+
+	since = now.Add(-searchTTL)
+	for chatID, searches := range data.Searches {
+		if searches.Chat.At.Before(since) {
+			searches.Chat = lastSearch{}
+		}
+		for userID, search := range searches.Users {
+			if search.At.Before(since) {
+				delete(searches.Users, userID)
+			}
+		}
+		for messageID, search := range searches.Buttons {
+			if search.At.Before(since) {
+				delete(searches.Buttons, messageID)
+			}
+		}
+		if searches.Chat.Site == "" && len(searches.Users) == 0 && len(searches.Buttons) == 0 {
+			delete(data.Searches, chatID)
+			continue
+		}
+		data.Searches[chatID] = searches
+	}
+}
+
+// pickImages picks up to count images from search results that weren't sent to the chat recently:
+// the best ones or random ones, starting at query.page and looking at next pages when everything on a page was sent.
+// If everything was sent, it picks from the first page anyway. It also returns the last page that had results.
+// Posts that the chat doesn't allow are never picked, in case the booru didn't filter them out.
+func pickImages(ctx context.Context, backend booru, query booruQuery, isRandom bool, chatID int64, count int) ([]booruPost, int, error) {
+	recent := recentlySent(chatID)
+	site := siteName(backend)
+	first := query.page
+	if first < 1 {
+		first = 1
+	}
+	lastPage := first
+	picked := []booruPost{}
+	var firstPage []booruPost
+	for page := first; page < first+maxHistoryPages; page++ {
+		query.page = page
+		entries, more, err := getImages(ctx, backend, query)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !more {
+			break
+		}
+		lastPage = page
+		allowed := []booruPost{}
+		for _, entry := range entries {
+			if postAllowed(entry, chatID) {
+				allowed = append(allowed, entry)
+			}
+		}
+		if page == first {
+			firstPage = allowed
+		}
+		unseen := []booruPost{}
+		for _, entry := range allowed {
+			image := sentImage{Site: site, ID: entry.postID()}
+			if !recent[image] {
+				// pages can overlap when new images are posted, so remember it's taken
+				recent[image] = true
+				unseen = append(unseen, entry)
+			}
+		}
+		picked = append(picked, pickFrom(unseen, isRandom, count-len(picked))...)
+		if len(picked) == count {
+			return picked, lastPage, nil
+		}
+	}
+	if len(picked) == 0 {
+		picked = pickFrom(firstPage, isRandom, count)
+	}
+	return picked, lastPage, nil
+}
+
+// pickFrom picks up to count entries, the first ones or random ones
+func pickFrom(entries []booruPost, isRandom bool, count int) []booruPost {
+	if isRandom {
+		entries = append([]booruPost(nil), entries...)
+		rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	}
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecentImagesAreNotRepeated(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		sends    int
+		expected []string // post IDs in order, nil means distinct ones in any order
+	}{
+		{"best image steps to the next best", "/pony fluttershy", 4, []string{"1001", "1002", "1003", "1001"}},
+		{"random image avoids recent ones", "/randpony fluttershy", 3, nil},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			d, booru := newTestDerpibooru(t)
+			useSites(t, d)
+			chatID := int64(600 + i)
+			forgetHistory(t, chatID)
+
+			sent := []string{}
+			for n := 0; n < test.sends; n++ {
+				handleUpdate(context.Background(), testMessage(chatID, test.command))
+				// 1002 is animated, the rest are photos
+				calls := telegram.sent()
+				if len(calls) != n+1 {
+					t.Fatalf("expected %d images, got %v", n+1, telegram.calls)
+				}
+				link := strings.SplitN(calls[n].params.Get("caption"), "\n", 2)[0]
+				sent = append(sent, strings.TrimPrefix(link, booru.baseURL.String()+"/"))
+			}
+
+			if test.expected == nil {
+				if sent[0] == sent[1] || sent[1] == sent[2] || sent[0] == sent[2] {
+					t.Errorf("expected distinct images, got %v", sent)
+				}
+				return
+			}
+			if strings.Join(sent, " ") != strings.Join(test.expected, " ") {
+				t.Errorf("sent %v, expected %v", sent, test.expected)
+			}
+			// when everything was sent, next pages were searched before repeating
+			if got := booru.lastQuery().Get("page"); got != "3" {
+				t.Errorf("last page searched is %q, expected 3", got)
+			}
+		})
+	}
+}
+
+func TestHistoryLimits(t *testing.T) {
+	previousSize, previousTTL := bot.HistorySize, bot.HistoryTTL
+	bot.HistorySize, bot.HistoryTTL = 2, 60
+	defer func() { bot.HistorySize, bot.HistoryTTL = previousSize, previousTTL }()
+
+	chatID := int64(700)
+	for _, id := range []int64{1, 2, 3} {
+		rememberSent(chatID, "derpibooru", id)
+	}
+	recent := recentlySent(chatID)
+	if len(recent) != 2 || recent[sentImage{Site: "derpibooru", ID: 1}] {
+		t.Errorf("expected only the last 2 images, got %v", recent)
+	}
+
+	err := bot.store.update(func(data *storedData) {
+		data.History[chatID][0].SentAt = time.Now().Add(-time.Hour)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recent := recentlySent(chatID); len(recent) != 1 || !recent[sentImage{Site: "derpibooru", ID: 3}] {
+		t.Errorf("expected images older than history_ttl to be forgotten, got %v", recent)
+	}
+}
+
+func TestForgetExpired(t *testing.T) {
+	previousTTL := bot.HistoryTTL
+	bot.HistoryTTL = 60
+	defer func() { bot.HistoryTTL = previousTTL }()
+
+	now := time.Now()
+	fresh, old := now.Add(-time.Second), now.Add(-searchTTL-time.Hour)
+	data := newStoredData()
+	data.History[1] = []sentImage{{Site: "derpibooru", ID: 1, SentAt: old}, {Site: "derpibooru", ID: 2, SentAt: fresh}}
+	data.History[2] = []sentImage{{Site: "derpibooru", ID: 3, SentAt: now.Add(-time.Hour)}}
+	data.Searches[3] = chatSearches{
+		Chat:    lastSearch{Site: "derpibooru", Search: "fluttershy", At: old},
+		Users:   map[int64]lastSearch{7: {Site: "derpibooru", Search: "applejack", At: fresh}, 8: {Site: "derpibooru", At: old}},
+		Buttons: map[int64]lastSearch{10: {Site: "derpibooru", At: old}},
+	}
+	data.Searches[4] = chatSearches{Chat: lastSearch{Site: "derpibooru", Search: "rarity", At: old}}
+
+	forgetExpired(data, now)
+
+	if history := data.History[1]; len(history) != 1 || history[0].ID != 2 {
+		t.Errorf("expected only the fresh image to stay in chat 1, got %v", history)
+	}
+	if history, ok := data.History[2]; ok {
+		t.Errorf("expected chat 2 without fresh images to be forgotten, got %v", history)
+	}
+	searches := data.Searches[3]
+	if searches.Chat.Site != "" || len(searches.Users) != 1 || searches.Users[7].Search != "applejack" || len(searches.Buttons) != 0 {
+		t.Errorf("expected only the fresh search to stay in chat 3, got %+v", searches)
+	}
+	if searches, ok := data.Searches[4]; ok {
+		t.Errorf("expected chat 4 without fresh searches to be forgotten, got %+v", searches)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxMediaGroup     = 10  // telegram doesn't allow more items in an album
+	maxButtonSearches = 100 // Another buttons under older images in a chat stop working
+
+	searchTTL = 7 * 24 * time.Hour // /more and Another buttons stop working for searches older than that
+)
+
+// rememberSearch keeps the search for /more, for the chat and in groups also for the user
+func rememberSearch(message *telegramMessage, search lastSearch) {
+	if bot.store == nil {
+		return
+	}
+	search.At = time.Now()
+	err := bot.store.update(func(data *storedData) {
+		searches := data.Searches[message.Chat.ID]
+		searches.Chat = search
+		if message.Chat.Type != "private" && message.From != nil {
+			if searches.Users == nil {
+				searches.Users = map[int64]lastSearch{}
+			}
+			searches.Users[message.From.ID] = search
+		}
+		data.Searches[message.Chat.ID] = searches
+	})
+	if err != nil {
+		log.Printf("Failed to remember search in chat %d: %s", message.Chat.ID, err)
+	}
+}
+
+// lastSearchFor finds the search that /more continues: user's own in groups, or the last one in the chat
+func lastSearchFor(message *telegramMessage) (lastSearch, bool) {
+	var search lastSearch
+	if bot.store == nil {
+		return search, false
+	}
+	bot.store.view(func(data *storedData) {
+		searches := data.Searches[message.Chat.ID]
+		search = searches.Chat
+		if message.From != nil {
+			if own, ok := searches.Users[message.From.ID]; ok {
+				search = own
+			}
+		}
+	})
+	return search, search.Site != ""
+}
+
+// rememberButtonSearch keeps the search that Another button under the reply to the message continues
+func rememberButtonSearch(chatID, messageID int64, search lastSearch) {
+	if bot.store == nil {
+		return
+	}
+	search.At = time.Now()
+	err := bot.store.update(func(data *storedData) {
+		searches := data.Searches[chatID]
+		if searches.Buttons == nil {
+			searches.Buttons = map[int64]lastSearch{}
+		}
+		searches.Buttons[messageID] = search
+		// message IDs only grow in a chat, so the lowest ones are the oldest
+		for len(searches.Buttons) > maxButtonSearches {
+			oldest := messageID
+			for id := range searches.Buttons {
+				if id < oldest {
+					oldest = id
+				}
+			}
+			delete(searches.Buttons, oldest)
+		}
+		data.Searches[chatID] = searches
+	})
+	if err != nil {
+		log.Printf("Failed to remember search for buttons in chat %d: %s", chatID, err)
+	}
+}
+
+// buttonSearch finds the search that Another button continues
+func buttonSearch(chatID, messageID int64) (lastSearch, bool) {
+	var search lastSearch
+	var ok bool
+	if bot.store == nil {
+		return search, false
+	}
+	bot.store.view(func(data *storedData) {
+		search, ok = data.Searches[chatID].Buttons[messageID]
+	})
+	return search, ok
+}
+
+// sendPosts sends the posts in one message or as an album, with links to all of them in the caption.
+// search is what the posts were found by, Another button under a single post continues it.
+func sendPosts(ctx context.Context, update telegramUpdate, backend booru, posts []booruPost, caption string, search *lastSearch) error {
+	medias := []booruMedia{}
+	links := []string{}
+	for _, post := range posts {
+		media, err := post.media()
+		if err != nil {
+			return err
+		}
+		medias = append(medias, media)
+		links = append(links, backend.postURL(post.postID()))
+	}
+	caption = truncateCaption(strings.Join(links, "\n") + "\n" + caption)
+	var err error
+	if len(posts) == 1 {
+		// albums can't have buttons
+		markup := imageButtons(update.Message, siteName(backend), posts[0].postID(), search != nil)
+		err = bot.sendMedia(ctx, update, medias[0], caption, markup)
+		if err == nil && markup != nil && search != nil {
+			behind := *search
+			if behind.By == 0 && update.Message.From != nil {
+				behind.By = update.Message.From.ID
+			}
+			rememberButtonSearch(update.Message.Chat.ID, update.Message.ID, behind)
+		}
+	} else {
+		err = bot.sendMediaGroup(ctx, update, medias, caption)
+	}
+	if err != nil {
+		return err
+	}
+	for _, post := range posts {
+		rememberSent(update.Message.Chat.ID, siteName(backend), post.postID())
+	}
+	return nil
+}
+
+// splitCount separates the number of images asked for with "x5" at the end of the search, one if not asked.
+// Asking for more than fits in an album gets a full album.
+func splitCount(search string) (string, int) {
+	fields := strings.Fields(search)
+	if len(fields) == 0 {
+		return search, 1
+	}
+	last := strings.ToLower(fields[len(fields)-1])
+	if len(last) < 2 || last[0] != 'x' || strings.Trim(last[1:], "0123456789") != "" {
+		return search, 1
+	}
+	count, err := strconv.Atoi(last[1:])
+	switch {
+	case errors.Is(err, strconv.ErrRange) || count > maxMediaGroup:
+		count = maxMediaGroup
+	case err != nil || count < 1:
+		return search, 1
+	}
+	search = strings.TrimSpace(search)
+	return strings.TrimSpace(search[:len(search)-len(last)]), count
+}
+
+// --------------------
+// follow-up command handlers
+// --------------------
+func handleMore(ctx context.Context, update telegramUpdate) error {
+	count := 1
+	if arg := strings.TrimSpace(update.Message.CommandOptions()); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > maxMediaGroup {
+			return bot.sendMessage(ctx, update, fmt.Sprintf("Usage: /%s [how many, up to %d]", update.Message.Command(), maxMediaGroup))
+		}
+		count = n
+	}
+	if limit := chatAlbumLimit(update.Message.Chat.ID); count > limit {
+		count = limit
+	}
+	return continueSearch(ctx, update, count)
+}
+
+// continueSearch sends count more images for the last search that the message's author made
+func continueSearch(ctx context.Context, update telegramUpdate, count int) error {
+	last, ok := lastSearchFor(update.Message)
+	if !ok {
+		return bot.sendMessage(ctx, update, "There's no search to continue yet, search for something first.")
+	}
+	next, err := sendNext(ctx, update, last, count)
+	if err != nil {
+		return err
+	}
+	rememberSearch(update.Message, next)
+	return nil
+}
+
+// sendNext sends count more images for the search, and returns the search moved past them
+func sendNext(ctx context.Context, update telegramUpdate, last lastSearch, count int) (lastSearch, error) {
+	backend, ok := bot.sites[last.Site]
+	if !ok {
+		return last, bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, %s isn't available anymore.", last.Site))
+	}
+
+	// the chat could have lowered its rating since the search was made
+	chatID := update.Message.Chat.ID
+	maxRating := chatMaxRating(chatID)
+	if last.Rating != "" && !ratingAllowed(last.Rating, maxRating) {
+		return last, refuseRating(ctx, update, last.Rating, maxRating)
+	}
+	node, err := backend.parseQuery(last.Search)
+	if err != nil {
+		return last, err
+	}
+	if requested := requestedRating(node); requested != "" && !ratingAllowed(requested, maxRating) {
+		return last, refuseRating(ctx, update, requested, maxRating)
+	}
+
+	err = bot.sendChatAction(ctx, update, "upload_photo")
+	if err != nil {
+		return last, err
+	}
+
+	query := chatQuery(chatID, backend, last.Search, last.Limiter, last.Rating)
+	query.page = last.Page
+	posts, page, err := pickImages(ctx, backend, query, last.Random, chatID, count)
+	if err != nil {
+		return last, err
+	}
+	if len(posts) == 0 {
+		return last, bot.sendMessage(ctx, update, "Sorry, there are no more images for that search.")
+	}
+
+	caption := "Next image for your search"
+	if len(posts) > 1 {
+		caption = "More images for your search"
+	}
+	next := last
+	next.Page = page
+	err = sendPosts(ctx, update, backend, posts, caption, &next)
+	if err != nil {
+		return last, err
+	}
+	return next, nil
+}
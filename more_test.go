@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHandleMore(t *testing.T) {
+	tests := []struct {
+		name      string
+		search    string // sent before /more, if not empty
+		maxRating string // set after the search
+		text      string
+		method    string
+		expected  string // caption or text, {booru} is replaced with the fake booru URL
+	}{
+		{
+			name: "nothing to continue", text: "/more",
+			method: "sendMessage", expected: "There's no search to continue yet, search for something first.",
+		},
+		{
+			name: "next image", search: "/pony fluttershy", text: "/more",
+			method: "sendAnimation", expected: "{booru}/1002\nNext image for your search",
+		},
+		{
+			name: "next is the same as more", search: "/pony fluttershy", text: "/next",
+			method: "sendAnimation", expected: "{booru}/1002\nNext image for your search",
+		},
+		{
+			name: "album", search: "/pony fluttershy", text: "/more 2",
+			method: "sendMediaGroup", expected: "{booru}/1002\n{booru}/1003\nMore images for your search",
+		},
+		{
+			name: "too many", search: "/pony fluttershy", text: "/more 11",
+			method: "sendMessage", expected: "Usage: /more [how many, up to 10]",
+		},
+		{
+			name: "rating lowered since the search", search: "/clop", maxRating: "safe", text: "/more",
+			method: "sendMessage", expected: "Sorry, explicit images are not allowed in this chat, it only allows up to safe.",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			d, booru := newTestDerpibooru(t)
+			useSites(t, d)
+			chatID := int64(800 + i)
+			forgetHistory(t, chatID)
+			forgetSearches(t, chatID)
+			if test.search != "" {
+				handleUpdate(context.Background(), testMessage(chatID, test.search))
+			}
+			if test.maxRating != "" {
+				useMaxRating(t, chatID, test.maxRating)
+			}
+
+			handleUpdate(context.Background(), testMessage(chatID, test.text))
+
+			calls := telegram.called(test.method)
+			if len(calls) == 0 {
+				t.Fatalf("expected %s, got %v", test.method, telegram.calls)
+			}
+			params := calls[len(calls)-1].params
+			var got string
+			switch test.method {
+			case "sendMessage":
+				got = params.Get("text")
+			case "sendMediaGroup":
+				album := []telegramInputMedia{}
+				err := json.Unmarshal([]byte(params.Get("media")), &album)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(album) != 2 || album[0].Type != "video" || album[1].Type != "photo" {
+					t.Errorf("unexpected album %+v", album)
+				}
+				got = album[0].Caption
+			default:
+				got = params.Get("caption")
+			}
+			if expected := strings.ReplaceAll(test.expected, "{booru}", booru.baseURL.String()); got != expected {
+				t.Errorf("got %q, expected %q", got, expected)
+			}
+		})
+	}
+}
+
+func TestLastSearchInGroups(t *testing.T) {
+	newFakeTelegram(t)
+	d, _ := newTestDerpibooru(t)
+	useSites(t, d)
+	chatID := int64(-100900)
+	forgetSearches(t, chatID)
+
+	fromUser := func(userID int64, text string) telegramUpdate {
+		update := testMessage(chatID, text)
+		update.Message.Chat.Type = "supergroup"
+		update.Message.From = &telegramUser{ID: userID, FirstName: "Tester"}
+		return update
+	}
+	handleUpdate(context.Background(), fromUser(1, "/pony fluttershy"))
+	handleUpdate(context.Background(), fromUser(2, "/randpony solo"))
+
+	tests := []struct {
+		userID int64
+		search string
+	}{
+		{1, "fluttershy"},
+		{2, "solo"},
+		{3, "solo"}, // users who didn't search continue the last search in the chat
+	}
+	for _, test := range tests {
+		last, ok := lastSearchFor(fromUser(test.userID, "/more").Message)
+		if !ok || last.Search != test.search {
+			t.Errorf("user %d continues %+v, expected search %q", test.userID, last, test.search)
+		}
+	}
+}
+
+func TestSplitCount(t *testing.T) {
+	tests := []struct {
+		search   string
+		expected string
+		count    int
+	}{
+		{"", "", 1},
+		{"fluttershy", "fluttershy", 1},
+		{"fluttershy x5", "fluttershy", 5},
+		{"fluttershy, solo X3", "fluttershy, solo", 3},
+		{"x10", "", 10},
+		{"fluttershy x11", "fluttershy", 10},
+		{"fluttershy x20", "fluttershy", 10},
+		{"fluttershy x99999999999999999999", "fluttershy", 10},
+		{"fluttershy x0", "fluttershy x0", 1},
+		{"fluttershy x+5", "fluttershy x+5", 1},
+		{"x", "x", 1},
+	}
+	for _, test := range tests {
+		search, count := splitCount(test.search)
+		if search != test.expected || count != test.count {
+			t.Errorf("splitCount(%q) = %q, %d, expected %q, %d", test.search, search, count, test.expected, test.count)
+		}
+	}
+}
+
+func TestHandleImageAlbum(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		album       int    // chat's limit, album_limit applies if zero
+		configLimit int    // album_limit from the config
+		blocked     string // tag blocked in the chat
+		expected    []int64
+	}{
+		{name: "album", text: "/pony fluttershy x3", expected: []int64{1001, 1002, 1003}},
+		{name: "capped by the chat", text: "/pony fluttershy x3", album: 2, expected: []int64{1001, 1002}},
+		{name: "capped by the config", text: "/pony fluttershy x3", configLimit: 2, expected: []int64{1001, 1002}},
+		{name: "blocked tags", text: "/pony fluttershy x3", blocked: "angel bunny", expected: []int64{1001, 1002}},
+		{name: "one is not an album", text: "/pony fluttershy x3", album: 1, expected: []int64{1001}},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			d, booru := newTestDerpibooru(t)
+			useSites(t, d)
+			chatID := int64(-100850 - i)
+			forgetHistory(t, chatID)
+			forgetSearches(t, chatID)
+			err := bot.chats.update(chatID, func(settings *chatSettings) {
+				settings.Album = test.album
+				if test.blocked != "" {
+					settings.BlockedTags = []string{test.blocked}
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				bot.chats.update(chatID, func(settings *chatSettings) {
+					settings.Album = 0
+					settings.BlockedTags = nil
+				})
+			})
+			bot.AlbumLimit = test.configLimit
+			t.Cleanup(func() { bot.AlbumLimit = 0 })
+
+			handleUpdate(context.Background(), testMessage(chatID, test.text))
+
+			links := []string{}
+			for _, id := range test.expected {
+				links = append(links, booru.baseURL.String()+"/"+strconv.FormatInt(id, 10))
+			}
+			if len(test.expected) == 1 {
+				calls := telegram.called("sendPhoto")
+				if len(calls) != 1 {
+					t.Fatalf("expected a photo, got %v", telegram.calls)
+				}
+				expected := links[0] + "\nBest recent image for your search"
+				if got := calls[0].params.Get("caption"); got != expected {
+					t.Errorf("got caption %q, expected %q", got, expected)
+				}
+				return
+			}
+
+			calls := telegram.called("sendMediaGroup")
+			if len(calls) != 1 {
+				t.Fatalf("expected one album, got %v", telegram.calls)
+			}
+			album := []telegramInputMedia{}
+			err = json.Unmarshal([]byte(calls[0].params.Get("media")), &album)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(album) != len(test.expected) || album[1].Type != "video" {
+				t.Errorf("unexpected album %+v", album)
+			}
+			expected := strings.Join(links, "\n") + "\nBest recent images for your search"
+			if album[0].Caption != expected {
+				t.Errorf("got caption %q, expected %q", album[0].Caption, expected)
+			}
+		})
+	}
+}
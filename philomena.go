@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	rate "github.com/beefsack/go-rate"
+)
+
+type philomenaEntry struct {
+	// fields we're not interested in are not here
+	ID              int64
+	Width           int
+	Height          int
+	Original_format string
+	Score           int64
+	Representations map[string]string
+	Tags            []string
+	Source_url      string   // older philomena versions have only one source
+	Source_urls     []string // newer ones can have many
+	// hidden images have no files anymore, e.g. deleted or merged into a duplicate
+	Hidden_from_users bool
+}
+
+// philomena is a booru running Philomena, the software behind derpibooru and many others
+type philomena struct {
+	name        string  // short name of the site, used in /pony site:name and in cache keys
+	baseURL     url.URL // where the site is, tests point it to a fake server
+	key         string
+	filterID    int // site's filter used instead of the user's default one, zero means user's default
+	blockedTags []string
+	tagAliases  map[string]string // short names of tags on this site, nil means there are none
+	rl          *rate.RateLimiter
+}
+
+// philomenaSite is a philomena booru from the config
+type philomenaSite struct {
+	Name     string `yaml:"name"` // e.g. "ponybooru", used in /pony site:ponybooru
+	URL      string `yaml:"url"`  // e.g. "https://ponybooru.org"
+	Key      string `yaml:"key"`
+	FilterID int    `yaml:"filter_id"`
+	// pony boorus other than derpibooru can use its short names of tags, like "ts" for twilight sparkle
+	PonyAliases bool `yaml:"pony_aliases"`
+}
+
+const (
+	derpibooruHello = "Hello! I'm a bot by @hmage that sends ponies from %s.\n\nTo get a random top scoring picture: /pony\n\nTo get best recent picture with Celestia: /pony Celestia\n\nTo get random recent picture with Celestia: /randpony Celestia\n\nYou get the idea :)"
+	philomenaMaxRPS = 10 // requests per second
+	// distance asked from reverse search, it's the site's default and anything further is rarely the same image
+	philomenaReverseDistance = 0.25
+)
+
+func newPhilomena(name string, baseURL url.URL, key string, blockedTags []string) *philomena {
+	return &philomena{
+		name:        name,
+		baseURL:     baseURL,
+		key:         key,
+		blockedTags: blockedTags,
+		rl:          rate.New(philomenaMaxRPS, time.Second),
+	}
+}
+
+func newDerpibooru(key string, blockedTags []string) *philomena {
+	d := newPhilomena("derpibooru", url.URL{Scheme: "https", Host: "derpibooru.org"}, key, blockedTags)
+	d.tagAliases = derpibooruTagAliases
+	return d
+}
+
+func (p *philomena) hello() string {
+	return fmt.Sprintf(derpibooruHello, p.baseURL.Host)
+}
+
+func (p *philomena) commands() map[string]func(context.Context, telegramUpdate) error {
+	return map[string]func(context.Context, telegramUpdate) error{
+		"pony":     handlePony,
+		"randpony": handleRandPony,
+		"clop":     handleClop,
+		"randclop": handleRandClop,
+	}
+}
+
+func (p *philomena) postURL(id int64) string {
+	return fmt.Sprintf("%s/%d", p.baseURL.String(), id)
+}
+
+// splitTags splits comma-separated tags, philomena tags can have spaces in them
+func (p *philomena) splitTags(s string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		tags = append(tags, strings.ToLower(tag))
+	}
+	return tags
+}
+
+// derpibooruTagAliases are short names people type instead of the real tags, they only make sense on pony boorus
+var derpibooruTagAliases = map[string]string{
+	"ts":       "twilight sparkle",
+	"rd":       "rainbow dash",
+	"aj":       "applejack",
+	"pp":       "pinkie pie",
+	"fs":       "fluttershy",
+	"celestia": "princess celestia",
+	"luna":     "princess luna",
+	"cadance":  "princess cadance",
+}
+
+func (p *philomena) parseQuery(search string) (*queryNode, error) {
+	node, err := parseDerpibooruQuery(search)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeQuery(node, p.tagAliases), nil
+}
+
+func (p *philomena) search(ctx context.Context, query booruQuery) ([]booruPost, bool, error) {
+	url := p.baseURL
+	url.Path = "/api/v1/json/search/images"
+	params := url.Query()
+
+	// if the key is set, use it
+	if p.key != "" {
+		params.Set("key", p.key)
+	}
+	filterID := p.filterID
+	if query.filterID != 0 {
+		filterID = query.filterID
+	}
+	if filterID != 0 {
+		params.Set("filter_id", strconv.Itoa(filterID))
+	}
+
+	search, err := p.parseQuery(query.search)
+	if err != nil {
+		return nil, false, err
+	}
+	q := []*queryNode{search}
+
+	// enforce limiter and rating
+	if query.limiter != "" {
+		q = append(q, tagQuery(strings.ToLower(query.limiter)))
+	}
+	switch {
+	case query.rating != "":
+		q = append(q, tagQuery(query.rating))
+	case query.maxRating != "":
+		q = append(q, derpibooruRatings(query.maxRating))
+	default:
+		q = append(q, tagQuery("safe"))
+	}
+
+	// chat's blocked tags change the results, so they go into the cache key
+	for _, tag := range query.blockedTags {
+		q = append(q, notQuery(tagQuery(tag)))
+	}
+
+	// cache key must only use user input, so ignore rest
+	// canonical form makes equivalent searches share the cache entry
+	canonical := normalizeQuery(andQuery(q...), p.tagAliases)
+	// filter hides images, so it changes the results too
+	cacheKey := p.name + ":search:" + canonical.String() + query.pageKey()
+	if filterID != 0 {
+		cacheKey += fmt.Sprintf(" filter:%d", filterID)
+	}
+
+	// synthesize more query parameters based on settings
+	q = []*queryNode{canonical}
+	// enforce blocked tags
+	for _, tag := range p.blockedTags {
+		q = append(q, notQuery(tagQuery(strings.ToLower(tag))))
+	}
+
+	// if search is empty, we need top scoring ones in last 3 days
+	if search == nil {
+		// empty search, choose best in last 3 days
+		from := time.Now().Add(time.Hour * 24 * 3 * -1)
+		q = append(q, tagQuery("created_at.gt:"+from.Format(time.RFC3339)))
+		params.Set("sf", "score")
+		params.Set("sd", "desc")
+	}
+
+	// we have our search query, set it and encode into URL
+	params.Set("q", formatDerpibooruQuery(andQuery(q...)))
+	if query.page > 1 {
+		params.Set("page", strconv.Itoa(query.page))
+	}
+	if query.perPage > 0 {
+		params.Set("per_page", strconv.Itoa(query.perPage))
+	}
+	url.RawQuery = params.Encode()
+	location := url.String()
+
+	// fetch the URL, cache to avoid re-fetching if possible
+	jsonBody, err := cachedGet(ctx, location, cacheKey, p.rl)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to get from URL %s: %w", location, err)
+	}
+
+	entries, err := parsePhilomenaImages(location, jsonBody)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// sort by score
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Score > entries[j].Score })
+
+	posts := make([]booruPost, len(entries))
+	for i := range entries {
+		posts[i] = entries[i]
+	}
+	return posts, len(entries) > 0, nil
+}
+
+// parsePhilomenaImages gets images out of a response with a list of them, like search results
+func parsePhilomenaImages(location string, jsonBody []byte) ([]philomenaEntry, error) {
+	root := map[string]*json.RawMessage{}
+	err := json.Unmarshal(jsonBody, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []philomenaEntry{}
+	parent := "images"
+	if root[parent] == nil {
+		return nil, fmt.Errorf("Response from URL %s has no %q in it", location, parent)
+	}
+	err = json.Unmarshal(*root[parent], &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// derpibooruRatings matches any rating up to maxRating
+func derpibooruRatings(maxRating string) *queryNode {
+	allowed := &queryNode{op: "or"}
+	for _, rating := range ratings {
+		allowed.children = append(allowed.children, tagQuery(rating))
+		if rating == maxRating {
+			break
+		}
+	}
+	if len(allowed.children) == 1 {
+		return allowed.children[0]
+	}
+	return allowed
+}
+
+func (p *philomena) getImage(ctx context.Context, id int64) (booruPost, error) {
+	url := p.baseURL
+	url.Path = fmt.Sprintf("/api/v1/json/images/%d", id)
+	query := url.Query()
+	if p.key != "" {
+		query.Set("key", p.key)
+	}
+	if p.filterID != 0 {
+		query.Set("filter_id", strconv.Itoa(p.filterID))
+	}
+	url.RawQuery = query.Encode()
+	location := url.String()
+
+	cacheKey := fmt.Sprintf("%s:image:%d", p.name, id)
+	jsonBody, err := cachedGet(ctx, location, cacheKey, p.rl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get from URL %s: %w", location, err)
+	}
+
+	root := map[string]*json.RawMessage{}
+	err = json.Unmarshal(jsonBody, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := "image"
+	if root[parent] == nil {
+		return nil, fmt.Errorf("Response from URL %s has no %q in it", location, parent)
+	}
+	entry := philomenaEntry{}
+	err = json.Unmarshal(*root[parent], &entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Hidden_from_users {
+		return nil, fmt.Errorf("Image %d is hidden: %w", id, errPostNotFound)
+	}
+	return entry, nil
+}
+
+// postIDFromURL recognizes https://derpibooru.org/images/123 and https://derpibooru.org/123
+func (p *philomena) postIDFromURL(u *url.URL) (int64, bool) {
+	if !sameHost(u, p.baseURL) {
+		return 0, false
+	}
+	return parsePostID(strings.TrimPrefix(strings.TrimPrefix(u.Path, "/images"), "/"))
+}
+
+// reverseSearch uploads the image to the site's reverse search
+// the site only tells which images are within the distance, so it's asked with growing distances
+// and every match gets the smallest distance it was found at
+func (p *philomena) reverseSearch(ctx context.Context, image []byte, filename string) ([]booruMatch, error) {
+	url := p.baseURL
+	url.Path = "/api/v1/json/search/reverse"
+	query := url.Query()
+	if p.key != "" {
+		query.Set("key", p.key)
+	}
+	url.RawQuery = query.Encode()
+	location := url.String()
+
+	params := mimeValues{}
+	err := params.AddFile("image", image, filename)
+	if err != nil {
+		return nil, err
+	}
+	err = params.Add("distance", strconv.FormatFloat(philomenaReverseDistance, 'f', -1, 64))
+	if err != nil {
+		return nil, err
+	}
+	jsonBody, err := postMultipart(ctx, location, params, p.rl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to post to URL %s: %w", location, err)
+	}
+	entries, err := parsePhilomenaImages(location, jsonBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// the site doesn't say how far each post is, only that it's within the distance
+	matches := []booruMatch{}
+	for _, entry := range entries {
+		if entry.Hidden_from_users {
+			continue
+		}
+		matches = append(matches, booruMatch{id: entry.ID, post: entry, distance: philomenaReverseDistance, within: true})
+	}
+	return matches, nil
+}
+
+func (p *philomena) systemFilters(ctx context.Context) ([]booruFilter, error) {
+	url := p.baseURL
+	url.Path = "/api/v1/json/filters/system"
+	location := url.String()
+
+	jsonBody, err := cachedGet(ctx, location, p.name+":filters:system", p.rl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get from URL %s: %w", location, err)
+	}
+
+	root := map[string]*json.RawMessage{}
+	err = json.Unmarshal(jsonBody, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := "filters"
+	if root[parent] == nil {
+		return nil, fmt.Errorf("Response from URL %s has no %q in it", location, parent)
+	}
+	filters := []booruFilter{}
+	err = json.Unmarshal(*root[parent], &filters)
+	if err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+func (p *philomena) inlineMedia(post booruPost) (booruMedia, error) {
+	entry, ok := post.(philomenaEntry)
+	if !ok {
+		return booruMedia{}, fmt.Errorf("Got %T instead of philomena entry", post)
+	}
+	photoURL, err := url.Parse(entry.Representations["tall"])
+	if err != nil {
+		return booruMedia{}, fmt.Errorf("Failed parsing photo URL: %w", err)
+	}
+	photoURL.Scheme = "https"
+	thumbURL, err := url.Parse(entry.Representations["thumb"])
+	if err != nil {
+		return booruMedia{}, fmt.Errorf("Failed parsing thumb URL: %w", err)
+	}
+	thumbURL.Scheme = "https"
+	media := booruMedia{
+		kind:     "photo",
+		url:      photoURL,
+		thumbURL: thumbURL,
+		width:    entry.Width,
+		height:   entry.Height,
+	}
+	if strings.HasSuffix(entry.Representations["tall"], ".gif") {
+		media.kind = "animation"
+	}
+	return media, nil
+}
+
+func (e philomenaEntry) postID() int64 {
+	return e.ID
+}
+
+func (e philomenaEntry) postScore() int64 {
+	return e.Score
+}
+
+// postRating finds the rating among the tags, philomena keeps ratings as tags
+func (e philomenaEntry) postRating() string {
+	for _, rating := range ratings {
+		if containsString(e.Tags, rating) {
+			return rating
+		}
+	}
+	return ""
+}
+
+func (e philomenaEntry) postTags() []string {
+	return e.Tags
+}
+
+// postArtists are artist tags without the "artist:" namespace
+func (e philomenaEntry) postArtists() []string {
+	artists := []string{}
+	for _, tag := range e.Tags {
+		if strings.HasPrefix(tag, "artist:") {
+			artists = append(artists, strings.TrimPrefix(tag, "artist:"))
+		}
+	}
+	return artists
+}
+
+func (e philomenaEntry) postSources() []string {
+	if len(e.Source_urls) > 0 {
+		return e.Source_urls
+	}
+	if e.Source_url != "" {
+		return []string{e.Source_url}
+	}
+	return nil
+}
+
+func (e philomenaEntry) media() (booruMedia, error) {
+	media := booruMedia{
+		width:    e.Width,
+		height:   e.Height,
+		filename: fmt.Sprintf("%d.%s", e.ID, e.Original_format),
+	}
+
+	location := e.Representations["tall"]
+	switch {
+	case e.Representations["mp4"] != "":
+		// If we have an mp4 representation, use it instead
+		media.kind = "animation"
+		location = e.Representations["mp4"]
+	case e.Original_format == "gif":
+		media.kind = "document"
+	default:
+		media.kind = "photo"
+	}
+
+	var err error
+	media.url, err = parseMediaURL(location)
+	if err != nil {
+		return booruMedia{}, err
+	}
+	return media, nil
+}
+
+// --------------------
+// philomena command handlers
+// --------------------
+func handlePony(ctx context.Context, update telegramUpdate) error {
+	return handleImage(ctx, update, "safe", "", false)
+}
+
+func handleRandPony(ctx context.Context, update telegramUpdate) error {
+	return handleImage(ctx, update, "safe", "", true)
+}
+
+func handleClop(ctx context.Context, update telegramUpdate) error {
+	return handleImage(ctx, update, "explicit", "", false)
+}
+
+func handleRandClop(ctx context.Context, update telegramUpdate) error {
+	return handleImage(ctx, update, "explicit", "", true)
+}
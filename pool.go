@@ -0,0 +1,118 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"sync"
+)
+
+const (
+	defaultWorkers   = 8
+	defaultQueueSize = 64
+)
+
+var (
+	metricUpdatesQueued  = expvar.NewInt("updates_queued")
+	metricUpdatesHandled = expvar.NewInt("updates_handled")
+	metricQueueFull      = expvar.NewInt("queue_full")
+)
+
+// workerPool handles updates with a fixed number of goroutines.
+// Updates from the same chat always go to the same worker, so replies come back in order.
+// When worker's queue is full, submit blocks, which slows down whoever feeds the pool.
+type workerPool struct {
+	queues []chan telegramUpdate
+	handle func(telegramUpdate)
+	wg     sync.WaitGroup
+
+	mu      sync.RWMutex // held for reading while submitting, so that stop doesn't close a queue under submit
+	stopped bool
+}
+
+func newWorkerPool(workers, queueSize int, handle func(telegramUpdate)) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	// each worker gets its share of the queue, but at least one slot
+	perWorker := queueSize / workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+	p := &workerPool{
+		queues: make([]chan telegramUpdate, workers),
+		handle: handle,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan telegramUpdate, perWorker)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *workerPool) work(queue chan telegramUpdate) {
+	defer p.wg.Done()
+	for update := range queue {
+		p.handle(update)
+		metricUpdatesHandled.Add(1)
+	}
+}
+
+// submit queues the update, blocking while the queue of its worker is full.
+// It returns false if the pool was already stopped and the update was not queued.
+func (p *workerPool) submit(update telegramUpdate) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return false
+	}
+	queue := p.queues[updateOrderKey(update)%uint64(len(p.queues))]
+	metricUpdatesQueued.Add(1)
+	select {
+	case queue <- update:
+	default:
+		metricQueueFull.Add(1)
+		log.Printf("Queue for update %d is full, waiting for workers", update.ID)
+		queue <- update
+	}
+	return true
+}
+
+// depth is the number of updates waiting for a worker
+func (p *workerPool) depth() int {
+	depth := 0
+	for _, queue := range p.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// stop waits for all queued updates to be handled, updates submitted after that are not queued
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// updateOrderKey picks which updates have to be handled in order relative to each other
+func updateOrderKey(update telegramUpdate) uint64 {
+	switch {
+	case update.Message != nil:
+		return uint64(update.Message.Chat.ID)
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		// buttons under images go in order with commands in the chat
+		return uint64(update.CallbackQuery.Message.Chat.ID)
+	case update.InlineQuery != nil && update.InlineQuery.From != nil:
+		return uint64(update.InlineQuery.From.ID)
+	}
+	return uint64(update.ID)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolKeepsChatOrder(t *testing.T) {
+	mu := sync.Mutex{}
+	seen := map[int64][]int64{}
+	pool := newWorkerPool(4, 8, func(update telegramUpdate) {
+		mu.Lock()
+		defer mu.Unlock()
+		chatID := update.Message.Chat.ID
+		seen[chatID] = append(seen[chatID], update.ID)
+	})
+
+	var id int64
+	for i := 0; i < 50; i++ {
+		for _, chatID := range []int64{-1001, 42, 7} {
+			id++
+			pool.submit(telegramUpdate{ID: id, Message: &telegramMessage{Chat: telegramChat{ID: chatID}}})
+		}
+	}
+	pool.stop()
+
+	for chatID, ids := range seen {
+		if len(ids) != 50 {
+			t.Fatalf("chat %d: expected 50 updates, got %d", chatID, len(ids))
+		}
+		for i := 1; i < len(ids); i++ {
+			if ids[i] < ids[i-1] {
+				t.Fatalf("chat %d: update %d was handled after %d", chatID, ids[i], ids[i-1])
+			}
+		}
+	}
+}
+
+func TestUpdateOrderKey(t *testing.T) {
+	chat := telegramChat{ID: -1001}
+	message := telegramUpdate{ID: 1, Message: &telegramMessage{Chat: chat}}
+	button := telegramUpdate{ID: 2, CallbackQuery: &telegramCallbackQuery{ID: "q", Message: &telegramMessage{Chat: chat}}}
+	if updateOrderKey(message) != updateOrderKey(button) {
+		t.Errorf("button presses and messages in the same chat must be handled in order")
+	}
+}
+
+func TestWorkerPoolSubmitAfterStop(t *testing.T) {
+	pool := newWorkerPool(2, 2, func(update telegramUpdate) {})
+	pool.stop()
+	// a webhook request can still be running when the pool is stopped
+	if pool.submit(telegramUpdate{ID: 1}) {
+		t.Errorf("expected the update not to be queued after stop")
+	}
+	pool.stop()
+}
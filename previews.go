@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxLinkPreviews  = 3    // links previewed from a single message, the rest are ignored
+	maxCaptionLength = 1024 // telegram refuses longer captions
+)
+
+// --------------------
+// link previews
+// --------------------
+
+// handleLinks previews links to posts in messages that aren't commands, if the chat turned previews on
+// nobody asked the bot, so posts that the chat doesn't allow are skipped silently
+func handleLinks(ctx context.Context, update telegramUpdate) error {
+	chatID := update.Message.Chat.ID
+	if !chatPreviews(chatID) {
+		return nil
+	}
+
+	backend := chatSite(chatID)
+	previewed := 0
+	for _, link := range update.Message.Links() {
+		if previewed >= maxLinkPreviews {
+			break
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		if u.Host == "" {
+			// telegram recognizes links like derpibooru.org/1 too
+			u, err = url.Parse("https://" + link)
+			if err != nil {
+				continue
+			}
+		}
+		site, id, ok := sitePostURL(backend, u)
+		if !ok {
+			continue
+		}
+		previewed++
+
+		err = previewPost(ctx, update, site, id)
+		if err != nil {
+			log.Printf("Failed to preview post %d on %s: %s", id, siteName(site), err)
+		}
+	}
+	return nil
+}
+
+// previewPost sends the post with its artists and tags, unless the chat doesn't allow it
+func previewPost(ctx context.Context, update telegramUpdate, backend booru, id int64) error {
+	post, err := backend.getImage(ctx, id)
+	if errors.Is(err, errPostNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	chatID := update.Message.Chat.ID
+	if !postAllowed(post, chatID) {
+		return nil
+	}
+	postRating := knownRating(post)
+
+	media, err := post.media()
+	if err != nil {
+		return err
+	}
+	// people didn't ask for the image, so anything but safe is hidden until tapped
+	media.spoiler = postRating != "safe"
+	return bot.sendMedia(ctx, update, media, previewCaption(backend.postURL(id), post), nil)
+}
+
+// previewCaption is the link, artists and tags of the post, cut to what telegram accepts
+func previewCaption(link string, post booruPost) string {
+	caption := link
+	if artists := post.postArtists(); len(artists) > 0 {
+		caption += "\nArtist: " + strings.Join(artists, ", ")
+	}
+	if tags := post.postTags(); len(tags) > 0 {
+		caption += "\nTags: " + strings.Join(tags, ", ")
+	}
+	return truncateCaption(caption)
+}
+
+// truncateCaption cuts the caption to maxCaptionLength characters, ending it with an ellipsis
+func truncateCaption(caption string) string {
+	if utf8.RuneCountInString(caption) <= maxCaptionLength {
+		return caption
+	}
+	runes := []rune(caption)
+	return string(runes[:maxCaptionLength-1]) + "…"
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestMessageLinks(t *testing.T) {
+	text := "🦄 look at derpibooru.org/1001 and this"
+	message := telegramMessage{
+		Text: text,
+		Entities: []telegramMessageEntity{
+			{Type: "bold", Offset: 0, Length: 2},
+			{Type: "url", Offset: 11, Length: 19},
+			{Type: "text_link", Offset: 35, Length: 4, URL: "https://e621.net/posts/2001"},
+			{Type: "url", Offset: 30, Length: 100}, // broken entity must not panic
+		},
+	}
+	expected := []string{"derpibooru.org/1001", "https://e621.net/posts/2001"}
+	if got := message.Links(); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Links() = %q, expected %q", got, expected)
+	}
+}
+
+func TestLinkPreviews(t *testing.T) {
+	tests := []struct {
+		name      string
+		previews  bool
+		maxRating string
+		link      string // path on the fake booru
+		caption   string // {booru} is replaced with the fake booru URL, empty means nothing is sent
+		spoiler   string
+	}{
+		{
+			name: "previews are off", link: "/images/1001",
+		},
+		{
+			name: "safe post", previews: true, link: "/images/1001",
+			caption: "{booru}/1001\nArtist: mixermilk\nTags: artist:mixermilk, fluttershy, safe, solo",
+		},
+		{
+			name: "explicit post is a spoiler", previews: true, link: "/1004",
+			caption: "{booru}/1004\nTags: explicit, princess luna, solo", spoiler: "true",
+		},
+		{
+			name: "rating above the chat ceiling", previews: true, maxRating: "questionable", link: "/1004",
+		},
+		{
+			name: "missing post", previews: true, link: "/images/999",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			d, booru := newTestDerpibooru(t)
+			useSites(t, d)
+			chatID := int64(400 + i)
+			if test.maxRating != "" {
+				useMaxRating(t, chatID, test.maxRating)
+			}
+			err := bot.chats.update(chatID, func(settings *chatSettings) {
+				settings.Previews = test.previews
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				bot.chats.update(chatID, func(settings *chatSettings) {
+					settings.Previews = false
+				})
+			})
+
+			link := booru.baseURL.String() + test.link
+			update := testMessage(chatID, "check this out: "+link)
+			update.Message.Entities = []telegramMessageEntity{
+				{Type: "url", Offset: 16, Length: len(utf16.Encode([]rune(link)))},
+			}
+			handleUpdate(context.Background(), update)
+
+			if test.caption == "" {
+				if len(telegram.calls) != 0 {
+					t.Fatalf("expected nothing to be sent, got %v", telegram.calls)
+				}
+				return
+			}
+			calls := append(telegram.called("sendPhoto"), telegram.called("sendAnimation")...)
+			if len(calls) != 1 {
+				t.Fatalf("expected a single preview, got %v", telegram.calls)
+			}
+			expected := strings.ReplaceAll(test.caption, "{booru}", booru.baseURL.String())
+			if got := calls[0].params.Get("caption"); got != expected {
+				t.Errorf("caption is %q, expected %q", got, expected)
+			}
+			if got := calls[0].params.Get("has_spoiler"); got != test.spoiler {
+				t.Errorf("has_spoiler is %q, expected %q", got, test.spoiler)
+			}
+		})
+	}
+}
+
+func TestTruncateCaption(t *testing.T) {
+	long := strings.Repeat("ё", maxCaptionLength+10)
+	got := []rune(truncateCaption(long))
+	if len(got) != maxCaptionLength || got[len(got)-1] != '…' {
+		t.Errorf("truncateCaption() gave %d characters ending with %q", len(got), got[len(got)-1])
+	}
+	if got := truncateCaption("short"); got != "short" {
+		t.Errorf("truncateCaption(%q) = %q", "short", got)
+	}
+}
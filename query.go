@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// queryNode is a node of parsed search query
+type queryNode struct {
+	op       string // "tag", "and", "or" or "not"
+	tag      string // only for "tag"
+	children []*queryNode
+}
+
+func tagQuery(tag string) *queryNode {
+	return &queryNode{op: "tag", tag: tag}
+}
+
+func notQuery(node *queryNode) *queryNode {
+	return &queryNode{op: "not", children: []*queryNode{node}}
+}
+
+// andQuery joins nodes that all have to match, nil nodes are skipped
+func andQuery(nodes ...*queryNode) *queryNode {
+	children := []*queryNode{}
+	for _, node := range nodes {
+		if node != nil {
+			children = append(children, node)
+		}
+	}
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	}
+	return &queryNode{op: "and", children: children}
+}
+
+// String is the canonical form of the query in derpibooru syntax
+func (n *queryNode) String() string {
+	return formatDerpibooruQuery(n)
+}
+
+type queryTokenKind int
+
+const (
+	tokenTag queryTokenKind = iota
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+}
+
+// parseDerpibooruQuery parses search in derpibooru syntax: tags are separated with commas, AND or &&,
+// alternatives with OR or ||, negated with -, ! or NOT, and grouped with parentheses.
+// Empty search gives nil node and no error.
+func parseDerpibooruQuery(search string) (*queryNode, error) {
+	tokens, err := tokenizeQuery(search)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q, did you forget a comma or OR between tags?", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+func tokenizeQuery(search string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	s := []rune(search)
+	i := 0
+	for i < len(s) {
+		switch {
+		case unicode.IsSpace(s[i]):
+			i++
+		case s[i] == '(':
+			tokens = append(tokens, queryToken{tokenOpen, "("})
+			i++
+		case s[i] == ')':
+			tokens = append(tokens, queryToken{tokenClose, ")"})
+			i++
+		case s[i] == ',':
+			tokens = append(tokens, queryToken{tokenAnd, ","})
+			i++
+		case hasPrefixAt(s, i, "&&"):
+			tokens = append(tokens, queryToken{tokenAnd, "&&"})
+			i += 2
+		case hasPrefixAt(s, i, "||"):
+			tokens = append(tokens, queryToken{tokenOr, "||"})
+			i += 2
+		case (s[i] == '-' || s[i] == '!') && i+1 < len(s) && !unicode.IsSpace(s[i+1]):
+			tokens = append(tokens, queryToken{tokenNot, string(s[i])})
+			i++
+		case isKeywordAt(s, i, "AND"):
+			tokens = append(tokens, queryToken{tokenAnd, "AND"})
+			i += 3
+		case isKeywordAt(s, i, "OR"):
+			tokens = append(tokens, queryToken{tokenOr, "OR"})
+			i += 2
+		case isKeywordAt(s, i, "NOT"):
+			tokens = append(tokens, queryToken{tokenNot, "NOT"})
+			i += 3
+		case s[i] == '"':
+			tag := strings.Builder{}
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				// backslash escapes quotes and itself
+				if s[end] == '\\' && end+1 < len(s) {
+					end++
+				}
+				tag.WriteRune(s[end])
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("quote at %q is never closed", string(s[i:]))
+			}
+			tokens = append(tokens, queryToken{tokenTag, normalizeTag(tag.String())})
+			i = end + 1
+		default:
+			tag, end := readTag(s, i)
+			tokens = append(tokens, queryToken{tokenTag, normalizeTag(tag)})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// readTag reads tag that starts at i, tags can have spaces and balanced parentheses in them, like "spike (g4)"
+func readTag(s []rune, i int) (string, int) {
+	start := i
+	depth := 0
+	for i < len(s) {
+		switch {
+		case s[i] == ',' || hasPrefixAt(s, i, "&&") || hasPrefixAt(s, i, "||"):
+			return string(s[start:i]), i
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			if depth == 0 {
+				return string(s[start:i]), i
+			}
+			depth--
+		case unicode.IsSpace(s[i]):
+			// words AND, OR and NOT end the tag
+			j := i
+			for j < len(s) && unicode.IsSpace(s[j]) {
+				j++
+			}
+			if isKeywordAt(s, j, "AND") || isKeywordAt(s, j, "OR") || isKeywordAt(s, j, "NOT") {
+				return string(s[start:i]), j
+			}
+		}
+		i++
+	}
+	return string(s[start:i]), i
+}
+
+func hasPrefixAt(s []rune, i int, prefix string) bool {
+	return strings.HasPrefix(string(s[i:]), prefix)
+}
+
+// isKeywordAt checks for a whole uppercase word at i, "ORANGE" or "or" are tags, not keywords
+func isKeywordAt(s []rune, i int, keyword string) bool {
+	if !hasPrefixAt(s, i, keyword) {
+		return false
+	}
+	if i > 0 && !unicode.IsSpace(s[i-1]) && s[i-1] != '(' && s[i-1] != ')' {
+		return false
+	}
+	end := i + len(keyword)
+	return end == len(s) || unicode.IsSpace(s[end]) || s[end] == '('
+}
+
+// normalizeTag lowercases the tag and squashes whitespace in it
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) parseOr() (*queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []*queryNode{left}
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind != tokenOr {
+			break
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &queryNode{op: "or", children: children}, nil
+}
+
+func (p *queryParser) parseAnd() (*queryNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	children := []*queryNode{left}
+	for {
+		token, ok := p.peek()
+		if !ok || token.kind != tokenAnd {
+			break
+		}
+		p.pos++
+		// trailing comma is harmless, people type it all the time
+		if next, ok := p.peek(); !ok || next.kind == tokenClose {
+			break
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &queryNode{op: "and", children: children}, nil
+}
+
+func (p *queryParser) parseNot() (*queryNode, error) {
+	token, ok := p.peek()
+	if ok && token.kind == tokenNot {
+		p.pos++
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNode{op: "not", children: []*queryNode{child}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (*queryNode, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("search ends where a tag was expected")
+	}
+	switch token.kind {
+	case tokenTag:
+		p.pos++
+		if token.text == "" {
+			return nil, fmt.Errorf("empty tag")
+		}
+		return &queryNode{op: "tag", tag: token.text}, nil
+	case tokenOpen:
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing, ok := p.peek()
+		if !ok || closing.kind != tokenClose {
+			return nil, fmt.Errorf("opening parenthesis is never closed")
+		}
+		p.pos++
+		return node, nil
+	case tokenClose:
+		return nil, fmt.Errorf("unexpected closing parenthesis")
+	}
+	return nil, fmt.Errorf("unexpected %q where a tag was expected", token.text)
+}
+
+// parseE621Query parses search in e621 syntax: tags are separated with spaces, negated with -,
+// and tags starting with ~ are alternatives, at least one of them has to match
+func parseE621Query(search string) (*queryNode, error) {
+	and := &queryNode{op: "and"}
+	or := &queryNode{op: "or"}
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		typed := word
+		group := and
+		if strings.HasPrefix(word, "~") {
+			group = or
+			word = word[1:]
+		}
+		negated := strings.HasPrefix(word, "-")
+		word = strings.TrimPrefix(word, "-")
+		if word == "" {
+			return nil, fmt.Errorf("%q on its own is not a tag, it goes right before one", typed)
+		}
+		node := &queryNode{op: "tag", tag: word}
+		if negated {
+			node = &queryNode{op: "not", children: []*queryNode{node}}
+		}
+		group.children = append(group.children, node)
+	}
+	switch len(or.children) {
+	case 0:
+	case 1:
+		// single alternative is simply required
+		and.children = append(and.children, or.children[0])
+	default:
+		and.children = append(and.children, or)
+	}
+	switch len(and.children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return and.children[0], nil
+	}
+	return and, nil
+}
+
+// tagRating returns our rating that the tag stands for, in derpibooru or e621 syntax
+func tagRating(tag string) string {
+	switch tag {
+	case "safe", "rating:s", "rating:safe":
+		return "safe"
+	case "suggestive":
+		return "suggestive"
+	case "questionable", "rating:q", "rating:questionable":
+		return "questionable"
+	case "explicit", "rating:e", "rating:explicit":
+		return "explicit"
+	}
+	return ""
+}
+
+// contentRatings are derpibooru's ratings for dark or gory content, images have them next to one of ratings,
+// like "grimdark, safe". Searches for them are checked against the rating ceiling like the rest of the search.
+var contentRatings = []string{"semi-grimdark", "grimdark", "grotesque"}
+
+// requestedRating is the highest rating that the query asks for, negated ratings don't count.
+// Empty string means the query doesn't mention any rating.
+func requestedRating(node *queryNode) string {
+	highest := ""
+	walkTags(node, func(tag string, negated bool) {
+		rating := tagRating(tag)
+		if rating != "" && !negated && ratingLevel(rating) > ratingLevel(highest) {
+			highest = rating
+		}
+	})
+	return highest
+}
+
+// requestsContentRating reports whether the query asks for one of contentRatings, negated ones don't count
+func requestsContentRating(node *queryNode) bool {
+	found := false
+	walkTags(node, func(tag string, negated bool) {
+		if !negated && containsString(contentRatings, tag) {
+			found = true
+		}
+	})
+	return found
+}
+
+// walkTags calls visit for every tag in the query, negated is whether the tag is under an odd number of nots
+func walkTags(node *queryNode, visit func(tag string, negated bool)) {
+	var walk func(node *queryNode, negated bool)
+	walk = func(node *queryNode, negated bool) {
+		if node == nil {
+			return
+		}
+		switch node.op {
+		case "tag":
+			visit(node.tag, negated)
+		case "not":
+			walk(node.children[0], !negated)
+		default:
+			for _, child := range node.children {
+				walk(child, negated)
+			}
+		}
+	}
+	walk(node, false)
+}
+
+// normalizeQuery resolves tag aliases and brings the tree to canonical form: nested ands and ors are flattened,
+// double negations dropped, duplicates removed and the rest sorted, so that equivalent searches look the same
+func normalizeQuery(node *queryNode, aliases map[string]string) *queryNode {
+	if node == nil {
+		return nil
+	}
+	switch node.op {
+	case "tag":
+		if alias, ok := aliases[node.tag]; ok {
+			return tagQuery(alias)
+		}
+		return tagQuery(node.tag)
+	case "not":
+		child := normalizeQuery(node.children[0], aliases)
+		if child.op == "not" {
+			return child.children[0]
+		}
+		return notQuery(child)
+	}
+
+	children := []*queryNode{}
+	seen := map[string]bool{}
+	for _, child := range node.children {
+		child = normalizeQuery(child, aliases)
+		flattened := []*queryNode{child}
+		if child.op == node.op {
+			flattened = child.children
+		}
+		for _, c := range flattened {
+			key := c.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			children = append(children, c)
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool { return children[i].String() < children[j].String() })
+	if len(children) == 1 {
+		return children[0]
+	}
+	return &queryNode{op: node.op, children: children}
+}
+
+// formatDerpibooruQuery serializes the tree into derpibooru search syntax
+func formatDerpibooruQuery(node *queryNode) string {
+	if node == nil {
+		return ""
+	}
+	switch node.op {
+	case "tag":
+		return quoteDerpibooruTag(node.tag)
+	case "not":
+		child := node.children[0]
+		if child.op == "and" || child.op == "or" {
+			return "-(" + formatDerpibooruQuery(child) + ")"
+		}
+		return "-" + formatDerpibooruQuery(child)
+	}
+	separator := ", "
+	if node.op == "or" {
+		separator = " || "
+	}
+	parts := []string{}
+	for _, child := range node.children {
+		part := formatDerpibooruQuery(child)
+		if (child.op == "and" || child.op == "or") && child.op != node.op {
+			part = "(" + part + ")"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, separator)
+}
+
+// quoteDerpibooruTag quotes tags that would otherwise be read as operators
+func quoteDerpibooruTag(tag string) string {
+	needsQuotes := tag == "" || strings.ContainsAny(tag, `,"\`) || strings.Contains(tag, "&&") || strings.Contains(tag, "||") ||
+		strings.HasPrefix(tag, "-") || strings.HasPrefix(tag, "!") || strings.HasPrefix(tag, "(")
+	depth := 0
+	for _, r := range tag {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				needsQuotes = true
+			}
+		}
+	}
+	if depth != 0 {
+		needsQuotes = true
+	}
+	for _, keyword := range []string{"AND", "OR", "NOT"} {
+		for _, word := range strings.Fields(tag) {
+			if word == keyword {
+				needsQuotes = true
+			}
+		}
+	}
+	if !needsQuotes {
+		return tag
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(tag) + `"`
+}
+
+// formatE621Query serializes the tree into e621 tags, e621 only understands tags, -tags and one group of ~tags
+func formatE621Query(node *queryNode) ([]string, error) {
+	if node == nil {
+		return []string{}, nil
+	}
+	children := []*queryNode{node}
+	if node.op == "and" {
+		children = node.children
+	}
+	tags := []string{}
+	hasAlternatives := false
+	for _, child := range children {
+		if child.op != "or" {
+			tag, err := formatE621Tag(child)
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, tag)
+			continue
+		}
+		if hasAlternatives {
+			return nil, fmt.Errorf("e621 can't search for %s, it only allows one group of ~alternatives", child)
+		}
+		hasAlternatives = true
+		for _, alternative := range child.children {
+			if alternative.op != "tag" {
+				return nil, fmt.Errorf("e621 can't search for %s, alternatives can only be plain tags", child)
+			}
+			tags = append(tags, "~"+alternative.tag)
+		}
+	}
+	return tags, nil
+}
+
+func formatE621Tag(node *queryNode) (string, error) {
+	switch {
+	case node.op == "tag":
+		return node.tag, nil
+	case node.op == "not" && node.children[0].op == "tag":
+		return "-" + node.children[0].tag, nil
+	}
+	return "", fmt.Errorf("e621 can't search for %s, it only understands tags, -tags and ~tags", node)
+}
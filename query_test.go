@@ -0,0 +1,227 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// dumpQuery prints the tree in prefix form so that tests can compare it
+func dumpQuery(node *queryNode) string {
+	if node == nil {
+		return "nil"
+	}
+	if node.op == "tag" {
+		return node.tag
+	}
+	children := []string{}
+	for _, child := range node.children {
+		children = append(children, dumpQuery(child))
+	}
+	return "(" + node.op + " " + strings.Join(children, " ") + ")"
+}
+
+func TestParseDerpibooruQuery(t *testing.T) {
+	tests := []struct {
+		search   string
+		expected string
+	}{
+		{"", "nil"},
+		{"Twilight  Sparkle", "twilight sparkle"},
+		{"twilight sparkle, solo,", "(and twilight sparkle solo)"},
+		{"safe OR suggestive", "(or safe suggestive)"},
+		{"a || b && c", "(or a (and b c))"},
+		{"(a || b), -c", "(and (or a b) (not c))"},
+		{"NOT explicit AND !grimdark", "(and (not explicit) (not grimdark))"},
+		{"spike (g4), solo", "(and spike (g4) solo)"},
+		{"orange, ORANGE", "(and orange orange)"},
+		{"explicitly drawn", "explicitly drawn"},
+		{`"a, b", c`, "(and a, b c)"},
+		{"score.gt:100", "score.gt:100"},
+	}
+	for _, test := range tests {
+		node, err := parseDerpibooruQuery(test.search)
+		if err != nil {
+			t.Errorf("parseDerpibooruQuery(%q) failed: %s", test.search, err)
+			continue
+		}
+		if got := dumpQuery(node); got != test.expected {
+			t.Errorf("parseDerpibooruQuery(%q) = %s, expected %s", test.search, got, test.expected)
+		}
+	}
+}
+
+func TestParseDerpibooruQueryErrors(t *testing.T) {
+	for _, search := range []string{"(a, b", "a)", "a ||", "a, (", `"a`, "a, ()"} {
+		if node, err := parseDerpibooruQuery(search); err == nil {
+			t.Errorf("parseDerpibooruQuery(%q) = %s, expected an error", search, dumpQuery(node))
+		}
+	}
+}
+
+func TestParseE621Query(t *testing.T) {
+	tests := []struct {
+		search   string
+		expected string
+	}{
+		{"", "nil"},
+		{"Canine", "canine"},
+		{"canine -solo rating:e", "(and canine (not solo) rating:e)"},
+		{"~fox ~wolf solo", "(and solo (or fox wolf))"},
+		{"~fox solo", "(and solo fox)"},
+	}
+	for _, test := range tests {
+		node, err := parseE621Query(test.search)
+		if err != nil {
+			t.Errorf("parseE621Query(%q) failed: %s", test.search, err)
+			continue
+		}
+		if got := dumpQuery(node); got != test.expected {
+			t.Errorf("parseE621Query(%q) = %s, expected %s", test.search, got, test.expected)
+		}
+	}
+	if _, err := parseE621Query("fox -"); err == nil {
+		t.Errorf("parseE621Query(%q) expected to fail", "fox -")
+	}
+}
+
+func TestRequestedRating(t *testing.T) {
+	tests := []struct {
+		search   string
+		expected string
+	}{
+		{"twilight sparkle", ""},
+		{"explicitly drawn, -explicit", ""},
+		{"safe", "safe"},
+		{"safe OR questionable", "questionable"},
+		{"NOT (explicit || suggestive), safe", "safe"},
+		{"-(-explicit)", "explicit"},
+		{"suggestive, !safe", "suggestive"},
+		{"semi-grimdark", ""}, // content ratings go with any rating, see requestsContentRating
+	}
+	for _, test := range tests {
+		node, err := parseDerpibooruQuery(test.search)
+		if err != nil {
+			t.Errorf("parseDerpibooruQuery(%q) failed: %s", test.search, err)
+			continue
+		}
+		if got := requestedRating(node); got != test.expected {
+			t.Errorf("requestedRating(%q) = %q, expected %q", test.search, got, test.expected)
+		}
+	}
+
+	node, err := parseE621Query("wolf rating:e -rating:s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := requestedRating(node); got != "explicit" {
+		t.Errorf("requestedRating of e621 search = %q, expected %q", got, "explicit")
+	}
+}
+
+func TestRequestsContentRating(t *testing.T) {
+	tests := []struct {
+		search   string
+		expected bool
+	}{
+		{"twilight sparkle", false},
+		{"semi-grimdark", true},
+		{"luna, (grimdark || grotesque)", true},
+		{"luna, -grimdark", false},
+		{"semi-grimdark artist:someone", false}, // it's one tag with spaces
+	}
+	for _, test := range tests {
+		node, err := parseDerpibooruQuery(test.search)
+		if err != nil {
+			t.Errorf("parseDerpibooruQuery(%q) failed: %s", test.search, err)
+			continue
+		}
+		if got := requestsContentRating(node); got != test.expected {
+			t.Errorf("requestsContentRating(%q) = %v, expected %v", test.search, got, test.expected)
+		}
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		search    string
+		canonical string
+	}{
+		{"solo, fs", "fluttershy, solo"},
+		{"fluttershy, solo, fluttershy", "fluttershy, solo"},
+		{"(a, b), (c, a)", "a, b, c"},
+		{"b || (a || b)", "a || b"},
+		{"-(-ts)", "twilight sparkle"},
+		{"c, (b || a)", "(a || b), c"},
+		{"x OR (b, a)", "(a, b) || x"},
+		{"-(a, b), score.gt:100", "-(a, b), score.gt:100"},
+		{`"a, b"`, `"a, b"`},
+		{`"say \"hi\""`, `"say \"hi\""`},
+	}
+	for _, test := range tests {
+		node, err := parseDerpibooruQuery(test.search)
+		if err != nil {
+			t.Errorf("parseDerpibooruQuery(%q) failed: %s", test.search, err)
+			continue
+		}
+		canonical := normalizeQuery(node, derpibooruTagAliases)
+		if got := canonical.String(); got != test.canonical {
+			t.Errorf("canonical form of %q = %q, expected %q", test.search, got, test.canonical)
+		}
+		// canonical form must parse back into the same query
+		reparsed, err := parseDerpibooruQuery(canonical.String())
+		if err != nil {
+			t.Errorf("parsing canonical form %q failed: %s", canonical, err)
+			continue
+		}
+		if got, expected := dumpQuery(normalizeQuery(reparsed, nil)), dumpQuery(canonical); got != expected {
+			t.Errorf("canonical form %q parsed back as %s, expected %s", canonical, got, expected)
+		}
+	}
+}
+
+func TestFormatE621Query(t *testing.T) {
+	tests := []struct {
+		query    *queryNode
+		expected string
+	}{
+		{nil, ""},
+		{andQuery(tagQuery("fox"), notQuery(tagQuery("rating:e"))), "fox -rating:e"},
+		{&queryNode{op: "or", children: []*queryNode{tagQuery("fox"), tagQuery("wolf")}}, "~fox ~wolf"},
+	}
+	for _, test := range tests {
+		tags, err := formatE621Query(test.query)
+		if err != nil {
+			t.Errorf("formatE621Query(%s) failed: %s", test.query, err)
+			continue
+		}
+		if got := strings.Join(tags, " "); got != test.expected {
+			t.Errorf("formatE621Query(%s) = %q, expected %q", test.query, got, test.expected)
+		}
+	}
+
+	nested := notQuery(andQuery(tagQuery("fox"), tagQuery("wolf")))
+	if _, err := formatE621Query(nested); err == nil {
+		t.Errorf("formatE621Query(%s) expected to fail", nested)
+	}
+}
+
+func TestTagAliasesArePerSite(t *testing.T) {
+	d, _ := newTestDerpibooru(t)
+	furbooru, _ := newTestPhilomena(t, "furbooru")
+	tests := []struct {
+		site     *philomena
+		expected string
+	}{
+		{d, "twilight sparkle"},
+		{furbooru, "ts"},
+	}
+	for _, test := range tests {
+		node, err := test.site.parseQuery("ts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := node.String(); got != test.expected {
+			t.Errorf("%s: ts is %q, expected %q", test.site.name, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	maxSendAttempts = 5
+	retryBaseDelay  = time.Second
+	retryMaxDelay   = 30 * time.Second
+)
+
+// telegramError is an error reported by telegram itself, as opposed to network errors
+type telegramError struct {
+	code        int
+	description string
+	parameters  telegramResponseParameters
+}
+
+func (e *telegramError) Error() string {
+	return fmt.Sprintf("Telegram API returned %d: %s", e.code, e.description)
+}
+
+// retryable is true for flood control and telegram's own server errors
+func (e *telegramError) retryable() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
+
+// parseTelegramResponse checks the response for errors and decodes result into result, if it's not nil
+func parseTelegramResponse(resp *http.Response, body []byte, result interface{}) error {
+	response := telegramResponse{}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			// proxies in front of telegram reply to 502 and 504 with html
+			return &telegramError{code: resp.StatusCode, description: resp.Status}
+		}
+		return fmt.Errorf("Couldn't decode response from Telegram API: %w", err)
+	}
+	if !response.OK {
+		code := response.ErrorCode
+		if code == 0 {
+			code = resp.StatusCode
+		}
+		return &telegramError{code: code, description: response.Description, parameters: response.Parameters}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// retryDelay is how long to wait before the next attempt, telegram's retry_after wins if it's set
+func retryDelay(attempt int, retryAfter int) time.Duration {
+	if retryAfter > 0 {
+		return time.Duration(retryAfter) * time.Second
+	}
+	// exponential backoff, randomized so that many callers don't retry at once
+	backoff := retryBaseDelay << uint(attempt-1)
+	if backoff <= 0 || backoff > retryMaxDelay {
+		backoff = retryMaxDelay
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// sleepContext sleeps for d, returning early with an error if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// migratedChatID returns the supergroup that the chat was migrated to, or the chat itself
+func (b *telegramBot) migratedChatID(chatID int64) int64 {
+	if b.store == nil {
+		return chatID
+	}
+	newChatID := chatID
+	b.store.view(func(data *storedData) {
+		if migrated, ok := data.ChatMigrations[chatID]; ok {
+			newChatID = migrated
+		}
+	})
+	return newChatID
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseTelegramResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		code       int // 0 means no error expected
+		retryable  bool
+		retryAfter int
+		migrateTo  int64
+	}{
+		{"ok", 200, `{"ok":true,"result":true}`, 0, false, 0, 0},
+		{"flood", 429, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`, 429, true, 7, 0},
+		{"migrated", 400, `{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat","parameters":{"migrate_to_chat_id":-1001234}}`, 400, false, 0, -1001234},
+		{"bad gateway", 502, `<html>502 Bad Gateway</html>`, 502, true, 0, 0},
+		{"forbidden", 403, `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`, 403, false, 0, 0},
+	}
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Status: http.StatusText(test.status)}
+		err := parseTelegramResponse(resp, []byte(test.body), nil)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		var tgErr *telegramError
+		if !errors.As(err, &tgErr) {
+			t.Errorf("%s: expected telegram error, got %v", test.name, err)
+			continue
+		}
+		if tgErr.code != test.code {
+			t.Errorf("%s: expected code %d, got %d", test.name, test.code, tgErr.code)
+		}
+		if tgErr.retryable() != test.retryable {
+			t.Errorf("%s: expected retryable %v", test.name, test.retryable)
+		}
+		if tgErr.parameters.RetryAfter != test.retryAfter {
+			t.Errorf("%s: expected retry_after %d, got %d", test.name, test.retryAfter, tgErr.parameters.RetryAfter)
+		}
+		if tgErr.parameters.MigrateToChatID != test.migrateTo {
+			t.Errorf("%s: expected migrate_to_chat_id %d, got %d", test.name, test.migrateTo, tgErr.parameters.MigrateToChatID)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if delay := retryDelay(1, 7); delay != 7*time.Second {
+		t.Errorf("expected retry_after to win, got %s", delay)
+	}
+	for attempt := 1; attempt < 100; attempt++ {
+		delay := retryDelay(attempt, 0)
+		if delay <= 0 || delay > retryMaxDelay {
+			t.Fatalf("attempt %d: delay %s is out of bounds", attempt, delay)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const maxSourceMatches = 5 // matches listed by /source
+
+// --------------------
+// reverse image search
+// --------------------
+
+// handleSource finds where the image in the message that /source replies to comes from
+func handleSource(ctx context.Context, update telegramUpdate) error {
+	backend, _ := siteFor(update.Message)
+	reverse, ok := backend.(reverseBooru)
+	if !ok {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, %s can't search by image.", siteName(backend)))
+	}
+
+	replyTo := update.Message.ReplyToMessage
+	if replyTo == nil {
+		return bot.sendMessage(ctx, update, "Reply with /source to an image to find where it comes from.")
+	}
+	fileID, filename, ok := replyTo.Image()
+	if !ok {
+		return bot.sendMessage(ctx, update, "Sorry, there's no image in that message. Reply with /source to a photo or an image file.")
+	}
+
+	err := bot.sendChatAction(ctx, update, "typing")
+	if err != nil {
+		return err
+	}
+	image, err := bot.getFile(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	matches, err := reverse.reverseSearch(ctx, image, filename)
+	if err != nil {
+		return err
+	}
+
+	// only list posts that the chat could have asked for
+	chatID := update.Message.Chat.ID
+	lines := []string{}
+	for _, match := range matches {
+		if len(lines) >= maxSourceMatches {
+			break
+		}
+		post := match.post
+		if post == nil {
+			post, err = backend.getImage(ctx, match.id)
+			if errors.Is(err, errPostNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !postAllowed(post, chatID) {
+			continue
+		}
+		if match.within {
+			lines = append(lines, fmt.Sprintf("%s (within %.2f)", backend.postURL(match.id), match.distance))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s (distance %.2f)", backend.postURL(match.id), match.distance))
+	}
+	if len(lines) == 0 {
+		return bot.sendMessage(ctx, update, fmt.Sprintf("Sorry, I couldn't find this image on %s.", siteName(backend)))
+	}
+	return bot.sendMessage(ctx, update, fmt.Sprintf("Matches on %s:\n\n%s", siteName(backend), strings.Join(lines, "\n")))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHandleSource(t *testing.T) {
+	photo := &telegramMessage{
+		ID: 5,
+		Photo: []telegramPhotoSize{
+			{FileID: "small", Width: 90, Height: 90},
+			{FileID: "big", Width: 1280, Height: 1280},
+		},
+	}
+	tests := []struct {
+		name      string
+		backend   string
+		maxRating string
+		replyTo   *telegramMessage
+		expected  string // {booru} is replaced with the fake booru URL
+	}{
+		{
+			name: "not a reply", backend: "derpibooru",
+			expected: "Reply with /source to an image to find where it comes from.",
+		},
+		{
+			name: "reply without image", backend: "derpibooru", replyTo: &telegramMessage{ID: 5, Text: "hi"},
+			expected: "Sorry, there's no image in that message. Reply with /source to a photo or an image file.",
+		},
+		{
+			name: "derpibooru", backend: "derpibooru", replyTo: photo,
+			expected: "Matches on derpibooru:\n\n{booru}/1001 (within 0.25)\n{booru}/1004 (within 0.25)",
+		},
+		{
+			name: "matches above the chat ceiling", backend: "derpibooru", maxRating: "safe", replyTo: photo,
+			expected: "Matches on derpibooru:\n\n{booru}/1001 (within 0.25)",
+		},
+		{
+			name: "image document", backend: "derpibooru", maxRating: "suggestive",
+			replyTo:  &telegramMessage{ID: 5, Document: &telegramDocument{FileID: "big", FileName: "pony.png", MimeType: "image/png"}},
+			expected: "Matches on derpibooru:\n\n{booru}/1001 (within 0.25)",
+		},
+		{
+			name: "e621", backend: "e621", replyTo: photo,
+			expected: "Matches on e621:\n\n{booru}/posts/2001 (distance 5.50)",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			telegram := newFakeTelegram(t)
+			telegram.results["getFile"] = `{"file_id": "big", "file_path": "photos/file_1.jpg"}`
+			fake := useTestBackend(t, test.backend, nil)
+			chatID := int64(500 + i)
+			if test.maxRating != "" {
+				useMaxRating(t, chatID, test.maxRating)
+			}
+			update := testMessage(chatID, "/source")
+			update.Message.ReplyToMessage = test.replyTo
+
+			handleUpdate(context.Background(), update)
+
+			calls := telegram.called("sendMessage")
+			if len(calls) == 0 {
+				t.Fatalf("expected sendMessage, got %v", telegram.calls)
+			}
+			expected := strings.ReplaceAll(test.expected, "{booru}", fake.baseURL.String())
+			if got := calls[len(calls)-1].params.Get("text"); got != expected {
+				t.Errorf("text is %q, expected %q", got, expected)
+			}
+			if test.replyTo == photo {
+				if got := telegram.called("getFile")[0].params.Get("file_id"); got != "big" {
+					t.Errorf("getFile was asked for %q, expected the biggest photo", got)
+				}
+			}
+			if test.backend == "derpibooru" && len(fake.requests) > 1 {
+				t.Errorf("expected the image to be uploaded once, got %v", fake.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// telegram picks update IDs randomly after a week of inactivity, so older offsets are meaningless
+	stateMaxAge = 7 * 24 * time.Hour
+)
+
+// botState is where handling of updates stopped, kept in the storage between restarts
+type botState struct {
+	// every update with ID up to and including Offset was handled
+	Offset int64 `json:"offset"`
+	// updates above Offset that were handled out of order, used to skip them when telegram re-sends them
+	Handled []int64 `json:"handled"`
+	// updates that were fetched but not handled yet, telegram doesn't send them again so they're replayed after restart
+	Pending []telegramUpdate `json:"pending,omitempty"`
+	SavedAt time.Time        `json:"saved_at"`
+}
+
+// updateTracker gives at-least-once handling of updates across restarts.
+// Updates are kept in the state from when they're fetched until they're handled,
+// so ones that were queued or running are replayed after restart, and updates that
+// were handled out of order are remembered so they are not handled twice.
+type updateTracker struct {
+	mu       sync.Mutex
+	store    storage // nil means don't persist
+	offset   int64
+	handled  map[int64]bool
+	inFlight map[int64]telegramUpdate
+	// when the last update was handled, used to forget the offset after long inactivity
+	updatedAt time.Time
+}
+
+func newUpdateTracker(store storage) *updateTracker {
+	return &updateTracker{
+		store:    store,
+		handled:  map[int64]bool{},
+		inFlight: map[int64]telegramUpdate{},
+	}
+}
+
+// loadUpdateTracker continues from the state in the storage
+func loadUpdateTracker(store storage) *updateTracker {
+	t := newUpdateTracker(store)
+	store.view(func(data *storedData) {
+		t.updatedAt = data.State.SavedAt
+		t.offset = data.State.Offset
+		for _, id := range data.State.Handled {
+			t.handled[id] = true
+		}
+		for _, update := range data.State.Pending {
+			t.inFlight[update.ID] = update
+		}
+	})
+	return t
+}
+
+// pending returns updates that were left unhandled before restart, oldest first
+func (t *updateTracker) pending() []telegramUpdate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sortedInFlight()
+}
+
+// lastHandled returns the update ID up to which everything was handled
+func (t *updateTracker) lastHandled() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+	return t.offset
+}
+
+// start marks the update as being handled and saves it until it's finished,
+// returns false if it's a duplicate that must be skipped
+func (t *updateTracker) start(update telegramUpdate) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+	if t.offset != 0 && update.ID <= t.offset {
+		return false
+	}
+	if _, ok := t.inFlight[update.ID]; ok || t.handled[update.ID] {
+		return false
+	}
+	t.inFlight[update.ID] = update
+	err := t.save()
+	if err != nil {
+		log.Printf("Failed to save state before update %d: %s", update.ID, err)
+	}
+	return true
+}
+
+// finish marks the update as handled and saves the new state
+func (t *updateTracker) finish(id int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inFlight, id)
+	t.handled[id] = true
+	t.updatedAt = time.Now()
+
+	// offset can move up to the lowest update that is still in flight
+	ids := make([]int64, 0, len(t.handled))
+	for handledID := range t.handled {
+		ids = append(ids, handledID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, handledID := range ids {
+		if t.hasInFlightBelow(handledID) {
+			break
+		}
+		t.offset = handledID
+		delete(t.handled, handledID)
+	}
+
+	return t.save()
+}
+
+// expire forgets the offset if nothing was handled for too long, caller must hold the lock
+func (t *updateTracker) expire() {
+	if t.offset == 0 && len(t.handled) == 0 {
+		return
+	}
+	if t.updatedAt.IsZero() || time.Since(t.updatedAt) <= stateMaxAge {
+		return
+	}
+	log.Printf("No updates were handled since %s, forgetting offset %d", t.updatedAt, t.offset)
+	t.offset = 0
+	t.handled = map[int64]bool{}
+}
+
+func (t *updateTracker) hasInFlightBelow(id int64) bool {
+	for inFlightID := range t.inFlight {
+		if inFlightID < id {
+			return true
+		}
+	}
+	return false
+}
+
+// save puts the state into the storage, caller must hold the lock
+func (t *updateTracker) save() error {
+	if t.store == nil {
+		return nil
+	}
+	state := botState{
+		Offset:  t.offset,
+		Handled: []int64{},
+		Pending: t.sortedInFlight(),
+		SavedAt: t.updatedAt,
+	}
+	for id := range t.handled {
+		state.Handled = append(state.Handled, id)
+	}
+	sort.Slice(state.Handled, func(i, j int) bool { return state.Handled[i] < state.Handled[j] })
+
+	return t.store.update(func(data *storedData) {
+		data.State = state
+	})
+}
+
+// sortedInFlight returns the updates in flight by ID, caller must hold the lock
+func (t *updateTracker) sortedInFlight() []telegramUpdate {
+	updates := make([]telegramUpdate, 0, len(t.inFlight))
+	for _, update := range t.inFlight {
+		updates = append(updates, update)
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].ID < updates[j].ID })
+	return updates
+}
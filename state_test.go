@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bot.data.json")
+
+	tracker := loadUpdateTracker(openTestStorage(t, filename))
+	for _, id := range []int64{10, 11, 12} {
+		update := testMessage(1, "/hello")
+		update.ID = id
+		if !tracker.start(update) {
+			t.Fatalf("expected update %d to start", id)
+		}
+	}
+	if tracker.start(telegramUpdate{ID: 11}) {
+		t.Fatalf("expected update 11 to be skipped while in flight")
+	}
+
+	// finishing out of order must not move offset past unfinished update
+	err = tracker.finish(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset := tracker.lastHandled(); offset != 0 {
+		t.Fatalf("expected offset 0, got %d", offset)
+	}
+
+	// simulate a crash and restart, 10 and 12 were never finished and come back from the state
+	tracker = loadUpdateTracker(openTestStorage(t, filename))
+	pending := tracker.pending()
+	if len(pending) != 2 || pending[0].ID != 10 || pending[1].ID != 12 {
+		t.Fatalf("expected updates 10 and 12 to be replayed, got %+v", pending)
+	}
+	if pending[0].Message == nil || pending[0].Message.Text != "/hello" {
+		t.Fatalf("replayed update lost its message: %+v", pending[0])
+	}
+	// and telegram re-sending any of them must not handle them twice
+	for _, id := range []int64{10, 11, 12} {
+		if tracker.start(telegramUpdate{ID: id}) {
+			t.Fatalf("expected re-sent update %d to be skipped", id)
+		}
+	}
+	for _, update := range pending {
+		err = tracker.finish(update.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if offset := tracker.lastHandled(); offset != 12 {
+		t.Fatalf("expected offset 12, got %d", offset)
+	}
+	if tracker.start(telegramUpdate{ID: 12}) {
+		t.Fatalf("expected update 12 to be skipped after it was handled")
+	}
+
+	// offset must survive restart too
+	tracker = loadUpdateTracker(openTestStorage(t, filename))
+	if offset := tracker.lastHandled(); offset != 12 {
+		t.Fatalf("expected offset 12 after restart, got %d", offset)
+	}
+	if pending := tracker.pending(); len(pending) != 0 {
+		t.Fatalf("expected nothing to replay, got %+v", pending)
+	}
+}
+
+func TestUpdateTrackerExpires(t *testing.T) {
+	tracker := newUpdateTracker(nil)
+	tracker.offset = 100
+	tracker.updatedAt = time.Now().Add(-stateMaxAge - time.Hour)
+	if !tracker.start(telegramUpdate{ID: 5}) {
+		t.Fatalf("expected update 5 to start after the offset expired")
+	}
+}
+
+func TestPollingDoesNotWaitForHandlers(t *testing.T) {
+	telegram := newFakeTelegram(t)
+	telegram.results["getUpdates"] = `[{"update_id": 10}, {"update_id": 11}, {"update_id": 12}]`
+	previous := bot.tracker
+	bot.tracker = newUpdateTracker(nil)
+	bot.lastKnownUpdateID = 9
+	t.Cleanup(func() {
+		bot.tracker = previous
+		bot.lastKnownUpdateID = 0
+	})
+
+	updates, err := bot.getUpdates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the batch is queued or running behind a slow handler, the next poll must still get newer updates
+	for _, update := range updates {
+		if !bot.tracker.start(update) {
+			t.Fatalf("expected update %d to start", update.ID)
+		}
+	}
+	_, err = bot.getUpdates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := telegram.called("getUpdates")
+	for i, expected := range []string{"10", "13"} {
+		if offset := calls[i].params.Get("offset"); offset != expected {
+			t.Errorf("poll %d sent offset %q, expected %q", i+1, offset, expected)
+		}
+	}
+}
+
+func TestShutdownKeepsUnhandledUpdates(t *testing.T) {
+	telegram := newFakeTelegram(t)
+	store := newMemoryStorage()
+	previous := bot.tracker
+	bot.tracker = newUpdateTracker(store)
+	bot.lastKnownUpdateID = 12
+	t.Cleanup(func() {
+		bot.tracker = previous
+		bot.lastKnownUpdateID = 0
+	})
+
+	// 10 is handled before shutdown, 11 and 12 were still queued when handlers were cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, id := range []int64{10, 11, 12} {
+		update := testMessage(1, "/hello")
+		update.ID = id
+		if !bot.tracker.start(update) {
+			t.Fatalf("expected update %d to start", id)
+		}
+	}
+	processUpdate(ctx, telegramUpdate{ID: 10})
+	cancel()
+	processUpdate(ctx, telegramUpdate{ID: 11, Message: &telegramMessage{Chat: telegramChat{ID: 1}, Text: "/hello"}})
+	processUpdate(ctx, telegramUpdate{ID: 12})
+	bot.confirmUpdates()
+
+	if sent := telegram.sent(); len(sent) != 0 {
+		t.Errorf("expected cancelled updates not to be handled, got %v", sent)
+	}
+	calls := telegram.called("getUpdates")
+	if len(calls) != 1 || calls[0].params.Get("offset") != "13" {
+		t.Errorf("expected offset 13 to be confirmed, got %v", calls)
+	}
+	// telegram won't send 11 and 12 again, they're replayed from the state after restart
+	pending := loadUpdateTracker(store).pending()
+	if len(pending) != 2 || pending[0].ID != 11 || pending[1].ID != 12 {
+		t.Errorf("expected updates 11 and 12 to be kept, got %+v", pending)
+	}
+}
+
+func TestPanickingUpdateIsHandled(t *testing.T) {
+	newFakeTelegram(t)
+	previous := bot.tracker
+	bot.tracker = newUpdateTracker(nil)
+	bot.tracker.offset = 9
+	bot.tracker.updatedAt = time.Now()
+	messageHandlers["panic"] = func(ctx context.Context, update telegramUpdate) error {
+		panic("broken handler")
+	}
+	t.Cleanup(func() {
+		bot.tracker = previous
+		delete(messageHandlers, "panic")
+	})
+
+	if !bot.tracker.start(telegramUpdate{ID: 10}) {
+		t.Fatalf("expected update 10 to start")
+	}
+	update := testMessage(1, "/panic")
+	update.ID = 10
+	processUpdate(context.Background(), update)
+
+	if offset := bot.tracker.lastHandled(); offset != 10 {
+		t.Errorf("expected the panicking update to be handled, offset is %d", offset)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// storageVersion is the layout of storedData, bump it and add a migration when the layout changes
+	storageVersion = 1
+	// how long the bot waits to write the data file after a change, to write many changes at once
+	storageFlushDelay = time.Second
+)
+
+// storedData is everything the bot remembers between restarts
+type storedData struct {
+	Version int                    `json:"version"`
+	Chats   map[int64]chatSettings `json:"chats"`
+	History map[int64][]sentImage  `json:"history"` // images sent to each chat, oldest first
+	// last searches in each chat, continued with /more
+	Searches map[int64]chatSearches `json:"searches"`
+	State    botState               `json:"state"`
+	// groups that were upgraded to supergroups, old chat ID to the new one
+	ChatMigrations map[int64]int64 `json:"chat_migrations"`
+}
+
+// sentImage is a post that the bot sent to a chat
+type sentImage struct {
+	Site   string    `json:"site"`
+	ID     int64     `json:"id"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// lastSearch is a search that /more continues
+type lastSearch struct {
+	Site    string `json:"site"`
+	Search  string `json:"search"`
+	Limiter string `json:"limiter,omitempty"`
+	Rating  string `json:"rating,omitempty"`
+	Random  bool   `json:"random,omitempty"`
+	Page    int    `json:"page"`         // page of results where the last image was found
+	By      int64  `json:"by,omitempty"` // who searched, for the buttons under the images
+	// when it was made or continued, searches older than searchTTL are forgotten
+	At time.Time `json:"at"`
+}
+
+// chatSearches are the last searches in a chat
+type chatSearches struct {
+	Chat  lastSearch           `json:"chat"`            // by anyone
+	Users map[int64]lastSearch `json:"users,omitempty"` // by every user, only in groups
+	// searches behind Another buttons, by the ID of the message that the image replied to
+	Buttons map[int64]lastSearch `json:"buttons,omitempty"`
+}
+
+// storage keeps storedData, callers hold no references to the data outside of view and update
+type storage interface {
+	// view calls read with the data, read must not change it
+	view(read func(data *storedData))
+	// update calls change with the data and saves what it did
+	update(change func(data *storedData)) error
+	// flush saves changes that update left for later right away
+	flush() error
+}
+
+// storageMigrations upgrade the data from the version they're keyed by to the next one
+var storageMigrations = map[int]func(raw map[string]json.RawMessage) error{
+	// version 0 is the chats file of older versions, it maps chat IDs to their settings
+	0: func(raw map[string]json.RawMessage) error {
+		chats, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		for key := range raw {
+			delete(raw, key)
+		}
+		raw["chats"] = chats
+		return nil
+	},
+}
+
+func newStoredData() *storedData {
+	return &storedData{
+		Version:  storageVersion,
+		Chats:    map[int64]chatSettings{},
+		History:  map[int64][]sentImage{},
+		Searches: map[int64]chatSearches{},
+
+		ChatMigrations: map[int64]int64{},
+	}
+}
+
+// parseStoredData reads data of any version, migrating it to the current one
+func parseStoredData(body []byte) (*storedData, error) {
+	raw := map[string]json.RawMessage{}
+	err := json.Unmarshal(body, &raw)
+	if err != nil {
+		return nil, err
+	}
+	version := 0
+	if raw["version"] != nil {
+		err = json.Unmarshal(raw["version"], &version)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse version: %w", err)
+		}
+	}
+	if version > storageVersion {
+		return nil, fmt.Errorf("Data version %d is newer than %d that this bot knows, was it written by a newer bot?", version, storageVersion)
+	}
+	for ; version < storageVersion; version++ {
+		err = storageMigrations[version](raw)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't migrate data from version %d: %w", version, err)
+		}
+	}
+	raw["version"] = json.RawMessage(fmt.Sprint(storageVersion))
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	data := newStoredData()
+	err = json.Unmarshal(migrated, data)
+	if err != nil {
+		return nil, err
+	}
+	// maps missing from the file come back as nil
+	if data.Chats == nil {
+		data.Chats = map[int64]chatSettings{}
+	}
+	if data.History == nil {
+		data.History = map[int64][]sentImage{}
+	}
+	if data.Searches == nil {
+		data.Searches = map[int64]chatSearches{}
+	}
+	if data.ChatMigrations == nil {
+		data.ChatMigrations = map[int64]int64{}
+	}
+	return data, nil
+}
+
+// memoryStorage keeps the data in memory only, it's lost on restart
+type memoryStorage struct {
+	mu   sync.Mutex
+	data *storedData
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{data: newStoredData()}
+}
+
+func (s *memoryStorage) view(read func(data *storedData)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	read(s.data)
+}
+
+func (s *memoryStorage) update(change func(data *storedData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change(s.data)
+	return nil
+}
+
+func (s *memoryStorage) flush() error {
+	return nil
+}
+
+// fileStorage keeps the data in memory and writes all of it to a JSON file.
+// Updates that come in quick succession, like one for every handled telegram update, are written together
+// at most flushDelay after the first of them, so a crash loses at most that much. Updates that were lost
+// include the offset of handled telegram updates, so those are handled again after restart.
+type fileStorage struct {
+	memoryStorage
+	filename   string
+	flushDelay time.Duration // zero writes on every update
+
+	writeMu sync.Mutex  // held while writing, so that older data never overwrites newer
+	timer   *time.Timer // pending write, guarded by mu
+}
+
+// openFileStorage reads the data file, missing file is not an error
+func openFileStorage(filename string, flushDelay time.Duration) (*fileStorage, error) {
+	s := &fileStorage{memoryStorage: memoryStorage{data: newStoredData()}, filename: filename, flushDelay: flushDelay}
+	body, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.data, err = parseStoredData(body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse data file %s: %w", filename, err)
+	}
+	return s, nil
+}
+
+func (s *fileStorage) update(change func(data *storedData)) error {
+	s.mu.Lock()
+	change(s.data)
+	if s.flushDelay <= 0 {
+		s.mu.Unlock()
+		return s.flush()
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.flushDelay, func() {
+			err := s.flush()
+			if err != nil {
+				log.Printf("Failed to save data to %s: %s", s.filename, err)
+			}
+		})
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// flush writes the data to the file now, it's called on shutdown so that pending updates aren't lost
+func (s *fileStorage) flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	body, err := json.MarshalIndent(s.data, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.filename, body)
+}
+
+// importLegacyFiles moves chats and state files of older versions into the storage, unless it already has data
+func importLegacyFiles(s storage, chatsFile, stateFile string) error {
+	empty := false
+	s.view(func(data *storedData) {
+		empty = len(data.Chats) == 0 && data.State.Offset == 0
+	})
+	if !empty {
+		return nil
+	}
+
+	var chats map[int64]chatSettings
+	body, err := ioutil.ReadFile(chatsFile)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		legacy, err := parseStoredData(body)
+		if err != nil {
+			return fmt.Errorf("Couldn't parse chats file %s: %w", chatsFile, err)
+		}
+		chats = legacy.Chats
+	}
+
+	var state botState
+	body, err = ioutil.ReadFile(stateFile)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		err = json.Unmarshal(body, &state)
+		if err != nil {
+			return fmt.Errorf("Couldn't parse state file %s: %w", stateFile, err)
+		}
+	}
+
+	if len(chats) == 0 && state.Offset == 0 {
+		return nil
+	}
+	return s.update(func(data *storedData) {
+		for chatID, settings := range chats {
+			data.Chats[chatID] = settings
+		}
+		data.State = state
+	})
+}
+
+// writeFileAtomic replaces the file, so that it's never seen half-written
+func writeFileAtomic(filename string, body []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(body)
+	if err == nil {
+		// data must be on disk before rename makes it the file, or a crash can leave an empty file
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return err
+	}
+	// rename itself is only durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStorage opens the data file, as if the bot was restarted
+func openTestStorage(t *testing.T, filename string) *fileStorage {
+	store, err := openFileStorage(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestParseStoredData(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		rating string
+		offset int64
+	}{
+		{"current version", `{"version": 1, "chats": {"-100123": {"max_rating": "safe"}}, "state": {"offset": 42}}`, "safe", 42},
+		{"chats file of older versions", `{"-100123": {"max_rating": "questionable"}}`, "questionable", 0},
+		{"empty", `{}`, "", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := parseStoredData([]byte(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Version != storageVersion {
+				t.Errorf("version is %d, expected %d", data.Version, storageVersion)
+			}
+			if got := data.Chats[-100123].MaxRating; got != test.rating {
+				t.Errorf("max rating is %q, expected %q", got, test.rating)
+			}
+			if data.State.Offset != test.offset {
+				t.Errorf("offset is %d, expected %d", data.State.Offset, test.offset)
+			}
+			if data.Chats == nil || data.History == nil || data.ChatMigrations == nil {
+				t.Errorf("maps must be ready to use")
+			}
+		})
+	}
+
+	if _, err := parseStoredData([]byte(`{"version": 1000}`)); err == nil {
+		t.Errorf("expected data from a newer version to be refused")
+	}
+}
+
+func TestImportLegacyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chatsFile := filepath.Join(dir, "bot.chats.json")
+	stateFile := filepath.Join(dir, "bot.state.json")
+	dataFile := filepath.Join(dir, "bot.data.json")
+	err = ioutil.WriteFile(chatsFile, []byte(`{"-100123": {"max_rating": "safe", "blocked_tags": ["spider"]}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(stateFile, []byte(`{"offset": 42, "handled": [44]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = importLegacyFiles(openTestStorage(t, dataFile), chatsFile, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := openTestStorage(t, dataFile)
+	settings := newChatStore(store).get(-100123)
+	if settings.MaxRating != "safe" || len(settings.BlockedTags) != 1 {
+		t.Errorf("unexpected settings after import: %+v", settings)
+	}
+	tracker := loadUpdateTracker(store)
+	if offset := tracker.lastHandled(); offset != 42 {
+		t.Errorf("expected offset 42 after import, got %d", offset)
+	}
+	if tracker.start(telegramUpdate{ID: 44}) {
+		t.Errorf("expected update 44 to be skipped after import")
+	}
+
+	// legacy files must not overwrite what was changed since
+	err = newChatStore(store).update(-100123, func(settings *chatSettings) {
+		settings.MaxRating = "explicit"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importLegacyFiles(store, chatsFile, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := newChatStore(openTestStorage(t, dataFile)).get(-100123).MaxRating; got != "explicit" {
+		t.Errorf("expected max rating explicit after second import, got %q", got)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	store := newMemoryStorage()
+	err := store.update(func(data *storedData) {
+		data.History[1] = append(data.History[1], sentImage{Site: "derpibooru", ID: 1001})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.view(func(data *storedData) {
+		if len(data.History[1]) != 1 || data.History[1][0].ID != 1001 {
+			t.Errorf("unexpected history %+v", data.History[1])
+		}
+	})
+}
+
+func TestFileStorageWritesInBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bot.data.json")
+
+	store, err := openFileStorage(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := int64(1); offset <= 3; offset++ {
+		err = store.update(func(data *storedData) {
+			data.State.Offset = offset
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("expected updates to wait for flush, file is there: %v", err)
+	}
+
+	err = store.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	openTestStorage(t, filename).view(func(data *storedData) {
+		if data.State.Offset != 3 {
+			t.Errorf("offset is %d after flush, expected 3", data.State.Offset)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+	webhookMaxBodySize  = 1 << 20 // updates are small, anything bigger is not from telegram
+)
+
+// runWebhook registers the webhook with telegram and serves updates until ctx is cancelled
+func (b *telegramBot) runWebhook(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(b.webhookLocalPath(), b.webhookHandler)
+	server := &http.Server{
+		Addr:         b.WebhookListen,
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Listening for webhook updates on %s", b.WebhookListen)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	err := b.setWebhook(ctx)
+	if err != nil {
+		server.Close()
+		return fmt.Errorf("Failed to set webhook: %w", err)
+	}
+
+	select {
+	case err = <-serverErr:
+		err = fmt.Errorf("Webhook server failed: %w", err)
+	case <-ctx.Done():
+		log.Printf("Shutting down webhook")
+	}
+
+	// ctx is already done, so use a fresh one to clean up
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	deleteErr := b.deleteWebhook(shutdownCtx)
+	if deleteErr != nil {
+		log.Printf("Failed to delete webhook: %s", deleteErr)
+	}
+
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.Printf("Failed to shut down webhook server: %s", shutdownErr)
+	}
+
+	return err
+}
+
+func (b *telegramBot) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := r.Header.Get(webhookSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(b.WebhookSecret)) != 1 {
+		log.Printf("Got webhook request from %s with wrong secret token", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	update := telegramUpdate{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, webhookMaxBodySize)).Decode(&update)
+	if err != nil {
+		log.Printf("Couldn't decode webhook update: %s", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	// reply right away, telegram will resend the update if we take too long
+	dispatchUpdate(update)
+	// telegram forgets the update once we reply, it must be on disk by then to be replayed after a crash
+	err = bot.store.flush()
+	if err != nil {
+		log.Printf("Failed to save update %d: %s", update.ID, err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// webhookLocalPath is the path that our HTTP server answers on
+func (b *telegramBot) webhookLocalPath() string {
+	return "/" + strings.Trim(b.WebhookPath, "/")
+}
+
+// webhookPublicURL is the URL that we ask telegram to post updates to
+func (b *telegramBot) webhookPublicURL() string {
+	return strings.TrimSuffix(b.WebhookURL, "/") + b.webhookLocalPath()
+}
+
+func (b *telegramBot) setWebhook(ctx context.Context) error {
+	params := mimeValues{}
+	err := params.Add("url", b.webhookPublicURL())
+	if err != nil {
+		return err
+	}
+	err = params.Add("secret_token", b.WebhookSecret)
+	if err != nil {
+		return err
+	}
+
+	return b.sendInternal(ctx, "setWebhook", params, telegramUpdate{})
+}
+
+func (b *telegramBot) deleteWebhook(ctx context.Context) error {
+	params := mimeValues{}
+	err := params.Add("drop_pending_updates", "false")
+	if err != nil {
+		return err
+	}
+
+	return b.sendInternal(ctx, "deleteWebhook", params, telegramUpdate{})
+}
+
+// isValidSecretToken checks the secret against what setWebhook accepts
+func isValidSecretToken(secret string) bool {
+	if len(secret) == 0 || len(secret) > 256 {
+		return false
+	}
+	for _, r := range secret {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9':
+		case r == '_' || r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
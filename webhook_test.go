@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	b := &telegramBot{WebhookSecret: "s3cret"}
+	tests := []struct {
+		name    string
+		method  string
+		secret  string
+		body    string
+		status  int
+		handled int // how many updates reached the workers
+	}{
+		{"ok", "POST", "s3cret", `{"update_id": 1}`, http.StatusOK, 1},
+		{"wrong secret", "POST", "wrong", `{"update_id": 1}`, http.StatusForbidden, 0},
+		{"no secret", "POST", "", `{"update_id": 1}`, http.StatusForbidden, 0},
+		{"bad json", "POST", "s3cret", `{`, http.StatusBadRequest, 0},
+		{"get", "GET", "s3cret", ``, http.StatusMethodNotAllowed, 0},
+	}
+	for _, test := range tests {
+		handled := 0
+		previous := bot.pool
+		bot.pool = newWorkerPool(1, 1, func(update telegramUpdate) { handled++ })
+		req := httptest.NewRequest(test.method, "/hook", strings.NewReader(test.body))
+		if test.secret != "" {
+			req.Header.Set(webhookSecretHeader, test.secret)
+		}
+		rec := httptest.NewRecorder()
+		b.webhookHandler(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rec.Code)
+		}
+		bot.pool.stop()
+		bot.pool = previous
+		if handled != test.handled {
+			t.Errorf("%s: expected %d updates to be handled, got %d", test.name, test.handled, handled)
+		}
+	}
+}
+
+func TestWebhookURL(t *testing.T) {
+	b := &telegramBot{WebhookURL: "https://example.com/bots/", WebhookPath: "/abc/"}
+	if got := b.webhookLocalPath(); got != "/abc" {
+		t.Errorf("expected local path /abc, got %s", got)
+	}
+	if got := b.webhookPublicURL(); got != "https://example.com/bots/abc" {
+		t.Errorf("expected public URL https://example.com/bots/abc, got %s", got)
+	}
+}